@@ -2,7 +2,9 @@ package rmqhttp
 
 import (
 	"fmt"
+	"os"
 	"runtime"
+	"time"
 )
 
 import (
@@ -14,25 +16,118 @@ import (
 )
 
 func mkConsumeCmd() *cobra.Command {
-	var queueName string
+	var queueSpecs []string
+	var configPath string
 	var consumers int
+	var prefetch int
+	var gracePeriod time.Duration
+	var successCodes, retryCodes, deadLetterCodes []string
+	var listenAddress string
+	var metricsHosts []string
+	var cancellations bool
+	var endpointPolicyConfig rmqhttp.EndpointPolicyConfig
 
 	var cmd = &cobra.Command{
 		Use:   "worker",
-		Short: "Pulls items off a RMQ queue, and sends them to their HTTP destination.",
+		Short: "Pulls items off RMQ queues, and sends them to their HTTP destination.",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if queueName == "" {
+			queues := []rmqhttp.QueueConfig{}
+			signingSecretConfigs := []rmqhttp.SigningSecretConfig{}
+			if configPath != "" {
+				config, err := rmqhttp.LoadWorkerConfig(configPath, consumers, prefetch)
+				if err != nil {
+					return err
+				}
+
+				queues = append(queues, config.Queues...)
+				signingSecretConfigs = append(signingSecretConfigs, config.SigningSecrets...)
+			}
+
+			for _, spec := range queueSpecs {
+				qc, err := rmqhttp.ParseQueueConfig(spec, consumers, prefetch)
+				if err != nil {
+					return err
+				}
+
+				queues = append(queues, qc)
+			}
+
+			if len(queues) == 0 {
 				return fmt.Errorf("must provide queue name to consume")
 			}
 
-			connectionString := getConnectionString()
-			rmqhttp.ConsumeQueue(connectionString, queueName, consumers)
-			return nil
+			statusPolicy := rmqhttp.DefaultStatusPolicy()
+			for _, codes := range []struct {
+				specs []string
+				set   *rmqhttp.StatusCodeSet
+			}{
+				{successCodes, &statusPolicy.Success},
+				{retryCodes, &statusPolicy.Retry},
+				{deadLetterCodes, &statusPolicy.DeadLetter},
+			} {
+				if codes.specs == nil {
+					continue
+				}
+
+				set, err := rmqhttp.ParseStatusCodeSet(codes.specs)
+				if err != nil {
+					return err
+				}
+
+				*codes.set = set
+			}
+
+			signingSecrets, err := rmqhttp.NewSigningSecrets(signingSecretConfigs, os.Getenv(rmqhttp.SigningSecretEnvName))
+			if err != nil {
+				return err
+			}
+
+			endpointPolicy, err := rmqhttp.NewEndpointPolicy(endpointPolicyConfig)
+			if err != nil {
+				return err
+			}
+
+			tlsConfig, err := getAmqpTLSConfig()
+			if err != nil {
+				return err
+			}
+
+			worker := rmqhttp.NewWorker(queues)
+			worker.SetAmqpTLSConfig(tlsConfig)
+			worker.SetCancellationsEnabled(cancellations)
+			worker.SetEndpointPolicy(endpointPolicy)
+			worker.SetSigningSecrets(signingSecrets)
+			worker.SetStatusPolicy(statusPolicy)
+			worker.SetListenAddress(listenAddress)
+			worker.SetMetricsHosts(metricsHosts)
+			if err := worker.Connect(getConnectionString()); err != nil {
+				return err
+			}
+
+			shutdownErr := make(chan error, 1)
+			go func() {
+				ctx, cancel := waitForShutdown(gracePeriod)
+				defer cancel()
+				shutdownErr <- worker.Shutdown(ctx)
+			}()
+
+			worker.Run()
+			return <-shutdownErr
 		},
 	}
 
-	cmd.Flags().StringVarP(&queueName, "queue", "q", "", "Queue to consume")
-	cmd.Flags().IntVarP(&consumers, "consumers", "c", runtime.NumCPU(), "Number of consumers to run")
+	cmd.Flags().StringSliceVarP(&queueSpecs, "queue", "q", nil, "Queue to consume, as name[:consumers[:prefetch]]; may be repeated")
+	cmd.Flags().StringVar(&configPath, "config", "", "JSON file listing the queues to consume")
+	cmd.Flags().IntVarP(&consumers, "consumers", "c", runtime.NumCPU(), "Number of consumers to run for queues that don't specify their own")
+	cmd.Flags().IntVar(&prefetch, "prefetch", 0, "Number of unacknowledged deliveries each consumer may hold for queues that don't specify their own; 0 is unlimited")
+	cmd.Flags().StringSliceVar(&successCodes, "success-codes", nil, "Status codes, classes (2xx), or ranges (200-299) that mean a task succeeded (default 2xx)")
+	cmd.Flags().StringSliceVar(&retryCodes, "retry-codes", nil, "Status codes that mean a task should be retried (default 408,429)")
+	cmd.Flags().StringSliceVar(&deadLetterCodes, "dead-letter-codes", nil, "Status codes that send a task straight to the DLQ (default 4xx)")
+	cmd.Flags().StringVar(&listenAddress, "listen", "", "Address to serve /metrics, /healthz, and /readyz on, like :9090; nothing is served if not given")
+	cmd.Flags().StringSliceVar(&metricsHosts, "metrics-host", nil, "Endpoint host, as host[:port], to label delivery metrics with; other hosts are labelled other; may be repeated")
+	cmd.Flags().BoolVar(&cancellations, "cancellations", true, "Drop tasks that have been cancelled; needs RabbitMQ 3.9 or newer, and is turned off if the broker is older")
+	addEndpointPolicyFlags(cmd, &endpointPolicyConfig)
+	cmd.Flags().DurationVar(&gracePeriod, "grace-period", 30*time.Second, "How long to let in-flight deliveries finish when shutting down")
 
 	return cmd
 }
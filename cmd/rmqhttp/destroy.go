@@ -13,8 +13,13 @@ func mkDestroyCmd() *cobra.Command {
 		Use:   "destroy",
 		Short: "Destroy the delay infrastructure",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			tlsConfig, err := getAmqpTLSConfig()
+			if err != nil {
+				return err
+			}
+
 			connectionString := getConnectionString()
-			return rmqhttp.DestroyInfrastructure(connectionString)
+			return rmqhttp.DestroyInfrastructureWithTLS(connectionString, tlsConfig)
 		},
 	}
 
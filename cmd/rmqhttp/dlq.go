@@ -0,0 +1,138 @@
+package rmqhttp
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+import (
+	"github.com/spf13/cobra"
+)
+
+import (
+	"github.com/Eagerod/rmqhttp/pkg/rmqhttp"
+)
+
+func mkDlqCmd() *cobra.Command {
+	var cmd = &cobra.Command{
+		Use:   "dlq",
+		Short: "Inspect and clean up a queue's dead letter queue",
+	}
+
+	cmd.AddCommand(mkDlqListCmd())
+	cmd.AddCommand(mkDlqProcessCmd(
+		"replay",
+		"Move tasks from a queue's dead letter queue back onto the queue with fresh retries",
+		(*rmqhttp.RMQ).ReplayDeadLetters,
+	))
+	cmd.AddCommand(mkDlqProcessCmd(
+		"purge",
+		"Delete tasks from a queue's dead letter queue",
+		(*rmqhttp.RMQ).PurgeDeadLetters,
+	))
+
+	return cmd
+}
+
+func mkDlqListCmd() *cobra.Command {
+	var queueName string
+	var offset int
+	var limit int
+
+	var cmd = &cobra.Command{
+		Use:   "list",
+		Short: "Print the tasks in a queue's dead letter queue without removing them",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if queueName == "" {
+				return fmt.Errorf("must provide a queue to inspect")
+			}
+
+			tlsConfig, err := getAmqpTLSConfig()
+			if err != nil {
+				return err
+			}
+
+			rmq := rmqhttp.NewRMQ()
+			rmq.TLSConfig = tlsConfig
+			if err := rmq.ConnectRMQ(getConnectionString()); err != nil {
+				return err
+			}
+			defer rmq.Close()
+
+			page, err := rmq.ListDeadLetters(queueName, offset, limit)
+			if err != nil {
+				return err
+			}
+
+			aJson, err := json.MarshalIndent(page, "", "  ")
+			if err != nil {
+				return err
+			}
+
+			// Print straight to console, so the output can be piped
+			//   elsewhere regardless of log level.
+			fmt.Println(string(aJson))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&queueName, "queue", "q", "", "Queue whose dead letters to list")
+	cmd.Flags().IntVar(&offset, "offset", 0, "Number of dead letters to skip")
+	cmd.Flags().IntVar(&limit, "limit", 20, "Number of dead letters to list")
+
+	return cmd
+}
+
+// Replay and purge take the same filters, and only differ in what they do to
+// the tasks that match.
+func mkDlqProcessCmd(use, short string, process func(*rmqhttp.RMQ, string, rmqhttp.DeadLetterFilter, bool) (*rmqhttp.DeadLetterResult, error)) *cobra.Command {
+	var queueName string
+	var filter rmqhttp.DeadLetterFilter
+	var dryRun bool
+
+	var cmd = &cobra.Command{
+		Use:   use,
+		Short: short,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if queueName == "" {
+				return fmt.Errorf("must provide a queue to %s", use)
+			}
+
+			tlsConfig, err := getAmqpTLSConfig()
+			if err != nil {
+				return err
+			}
+
+			rmq := rmqhttp.NewRMQ()
+			rmq.TLSConfig = tlsConfig
+			if err := rmq.ConnectRMQ(getConnectionString()); err != nil {
+				return err
+			}
+			defer rmq.Close()
+
+			// Tasks handled before a failure are still printed, since
+			//   they've already been moved or dropped.
+			result, processErr := process(rmq, queueName, filter, dryRun)
+			if result == nil {
+				return processErr
+			}
+
+			aJson, err := json.MarshalIndent(result, "", "  ")
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(string(aJson))
+			return processErr
+		},
+	}
+
+	cmd.Flags().StringVarP(&queueName, "queue", "q", "", "Queue whose dead letters to "+use)
+	cmd.Flags().StringVar(&filter.EndpointHost, "host", "", "Only tasks whose endpoint is on this host")
+	cmd.Flags().DurationVar(&filter.OlderThan, "older-than", 0, "Only tasks dead-lettered at least this long ago")
+	cmd.Flags().DurationVar(&filter.NewerThan, "newer-than", 0, "Only tasks dead-lettered at most this long ago")
+	cmd.Flags().IntVar(&filter.Limit, "limit", 0, "Act on at most this many tasks; 0 is unlimited")
+	cmd.Flags().BoolVar(&dryRun, "dry-run", false, "List the tasks that would be affected without changing anything")
+
+	return cmd
+}
@@ -13,8 +13,13 @@ func mkInitCmd() *cobra.Command {
 		Use:   "init",
 		Short: "Create the delay infrastructure",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			tlsConfig, err := getAmqpTLSConfig()
+			if err != nil {
+				return err
+			}
+
 			connectionString := getConnectionString()
-			return rmqhttp.DelayInfrastructure(connectionString)
+			return rmqhttp.DelayInfrastructureWithTLS(connectionString, tlsConfig)
 		},
 	}
 
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"time"
 )
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -18,10 +20,22 @@ import (
 
 func mkProduceCmd() *cobra.Command {
 	var queueName string
+	var allowedQueues []string
+	var publishTimeout time.Duration
+	var transient bool
+	var gracePeriod time.Duration
+	var idempotencyStore string
+	var idempotencyWindow time.Duration
+	var dlqMaxDepth int
+	var dlqMaxAge time.Duration
+	var authConfigPath string
+	var cancellations bool
+	var endpointPolicyConfig rmqhttp.EndpointPolicyConfig
+	var tlsCertPath, tlsKeyPath, clientCaPath string
 
 	var cmd = &cobra.Command{
 		Use:   "server",
-		Short: "Receives HTTP POSTs on / and sends them to a queue.",
+		Short: "Receives HTTP POSTs on / or /queues/{name} and sends them to a queue.",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			port := os.Getenv("PORT")
 			if port == "" {
@@ -29,30 +43,157 @@ func mkProduceCmd() *cobra.Command {
 			}
 			log.Infof("Starting RMQ HTTP Bridge on port %s", port)
 
-			if queueName == "" {
-				return fmt.Errorf("must provide a queue to target")
-			}
-
 			bindInterface := fmt.Sprintf("0.0.0.0:%s", port)
 
 			connectionString := getConnectionString()
 			r := mux.NewRouter()
 
+			amqpTlsConfig, err := getAmqpTLSConfig()
+			if err != nil {
+				return err
+			}
+
 			hc := rmqhttp.NewHttpController()
+			hc.SetAmqpTLSConfig(amqpTlsConfig)
+			hc.SetCancellationsEnabled(cancellations)
 			hc.SetManagementConnectionString(getManagementConnectionString())
+			hc.SetPublishTimeout(publishTimeout)
+			hc.SetPersistentByDefault(!transient)
+			hc.SetDeadLetterThresholds(rmqhttp.DeadLetterThresholds{MaxDepth: dlqMaxDepth, MaxAge: dlqMaxAge})
+			if err := hc.SetAllowedQueues(allowedQueues); err != nil {
+				return err
+			}
+
+			endpointPolicy, err := rmqhttp.NewEndpointPolicy(endpointPolicyConfig)
+			if err != nil {
+				return err
+			}
+			hc.SetEndpointPolicy(endpointPolicy)
+
+			switch idempotencyStore {
+			case "memory":
+				hc.SetIdempotencyStore(rmqhttp.NewMemoryIdempotencyStore(idempotencyWindow))
+			case "rmq":
+				store, err := rmqhttp.NewRMQIdempotencyStore(idempotencyWindow)
+				if err != nil {
+					return err
+				}
+
+				hc.SetIdempotencyStore(store)
+			default:
+				return fmt.Errorf("unknown idempotency store %q", idempotencyStore)
+			}
+
+			var authenticator *rmqhttp.Authenticator
+			if authConfigPath != "" {
+				authConfig, err := rmqhttp.LoadAuthConfig(authConfigPath)
+				if err != nil {
+					return err
+				}
+
+				authenticator, err = rmqhttp.NewAuthenticator(*authConfig)
+				if err != nil {
+					return err
+				}
+			}
+
+			tlsConfig, err := serverTlsConfig(tlsCertPath, tlsKeyPath, clientCaPath)
+			if err != nil {
+				return err
+			}
+
+			if authenticator != nil && authenticator.UsesClientCertificates() && clientCaPath == "" {
+				return fmt.Errorf("client certificate credentials need --client-ca")
+			}
+
 			if err := hc.Connect(connectionString, queueName); err != nil {
 				return err
 			}
 
-			r.HandleFunc("/", hc.HttpHandler).Methods("POST")
-			r.HandleFunc("/health", hc.HealthHandler).Methods("GET")
-			r.HandleFunc("/stats", hc.StatsHandler).Methods("GET")
-			http.Handle("/", r)
-			return http.ListenAndServe(bindInterface, nil)
+			queueRoute := fmt.Sprintf("/queues/{%s}", rmqhttp.QueueRouteVariable)
+
+			// Probes and metrics are left open, so they can be scraped
+			//   without credentials.
+			r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+			r.HandleFunc("/healthz", hc.LivenessHandler).Methods("GET")
+			r.HandleFunc("/health", hc.LivenessHandler).Methods("GET")
+			r.HandleFunc(queueRoute+"/readyz", hc.ReadinessHandler).Methods("GET")
+			if queueName != "" {
+				r.HandleFunc("/readyz", hc.ReadinessHandler).Methods("GET")
+			}
+
+			api := r.NewRoute().Subrouter()
+			if authenticator != nil {
+				api.Use(authenticator.Middleware)
+			}
+
+			if queueName != "" {
+				api.HandleFunc("/", hc.HttpHandler).Methods("POST")
+				api.HandleFunc("/dlq/alert", hc.DeadLetterAlertHandler).Methods("GET")
+				api.HandleFunc("/stats", hc.StatsHandler).Methods("GET")
+				api.HandleFunc("/dlq", hc.DeadLettersHandler).Methods("GET")
+				api.HandleFunc("/dlq/replay", hc.ReplayDeadLettersHandler).Methods("POST")
+				api.HandleFunc("/dlq/purge", hc.PurgeDeadLettersHandler).Methods("POST")
+			}
+
+			api.HandleFunc(fmt.Sprintf("/tasks/{%s}", rmqhttp.TaskIdRouteVariable), hc.CancelTaskHandler).Methods("DELETE")
+
+			q := api.PathPrefix(queueRoute).Subrouter()
+			q.HandleFunc("", hc.HttpHandler).Methods("POST")
+			q.HandleFunc("/dlq/alert", hc.DeadLetterAlertHandler).Methods("GET")
+			q.HandleFunc("/stats", hc.StatsHandler).Methods("GET")
+			q.HandleFunc("/dlq", hc.DeadLettersHandler).Methods("GET")
+			q.HandleFunc("/dlq/replay", hc.ReplayDeadLettersHandler).Methods("POST")
+			q.HandleFunc("/dlq/purge", hc.PurgeDeadLettersHandler).Methods("POST")
+
+			server := &http.Server{Addr: bindInterface, Handler: r, TLSConfig: tlsConfig}
+
+			shutdownErr := make(chan error, 1)
+			go func() {
+				ctx, cancel := waitForShutdown(gracePeriod)
+				defer cancel()
+
+				// Stop taking requests, and let in-flight publishes finish
+				//   before the connection goes away.
+				err := server.Shutdown(ctx)
+				if closeErr := hc.Close(); closeErr != nil && err == nil {
+					err = closeErr
+				}
+
+				shutdownErr <- err
+			}()
+
+			if tlsConfig != nil {
+				// The certificate comes from the TLS config, so it can be
+				//   reloaded.
+				err = server.ListenAndServeTLS("", "")
+			} else {
+				err = server.ListenAndServe()
+			}
+
+			if err != http.ErrServerClosed {
+				return err
+			}
+
+			return <-shutdownErr
 		},
 	}
 
-	cmd.Flags().StringVarP(&queueName, "queue", "q", "", "Queue to write to")
+	cmd.Flags().StringVarP(&queueName, "queue", "q", "", "Default queue to write to")
+	cmd.Flags().StringSliceVar(&allowedQueues, "allow-queue", nil, "Queue name or pattern that may be targeted through /queues/{name}; all queues are allowed if none are given")
+	cmd.Flags().DurationVar(&publishTimeout, "publish-timeout", 5*time.Second, "How long to wait for the broker to confirm a published message")
+	cmd.Flags().BoolVar(&transient, "transient", false, "Don't persist tasks to disk unless they ask to be")
+	cmd.Flags().StringVar(&idempotencyStore, "idempotency-store", "memory", "Where idempotency keys are kept; memory, or rmq to share them between replicas")
+	cmd.Flags().DurationVar(&idempotencyWindow, "idempotency-window", 24*time.Hour, "How long an idempotency key prevents duplicate tasks")
+	cmd.Flags().IntVar(&dlqMaxDepth, "dlq-max-depth", 0, "Number of dead letters /dlq/alert allows before alerting")
+	cmd.Flags().DurationVar(&dlqMaxAge, "dlq-max-age", 0, "How long the oldest dead letter may wait before /dlq/alert alerts; 0 doesn't check")
+	cmd.Flags().StringVar(&authConfigPath, "auth-config", "", "JSON file listing the credentials that may use the server; requests aren't authenticated if not given")
+	cmd.Flags().StringVar(&tlsCertPath, "tls-cert", "", "Certificate to serve HTTPS with; it is reloaded when the file changes")
+	cmd.Flags().StringVar(&tlsKeyPath, "tls-key", "", "Private key of --tls-cert")
+	cmd.Flags().StringVar(&clientCaPath, "client-ca", "", "CA bundle that client certificates are verified against; needs --tls-cert")
+	cmd.Flags().BoolVar(&cancellations, "cancellations", true, "Allow cancelling tasks with DELETE /tasks/{id}; needs RabbitMQ 3.9 or newer, and is turned off if the broker is older")
+	addEndpointPolicyFlags(cmd, &endpointPolicyConfig)
+	cmd.Flags().DurationVar(&gracePeriod, "grace-period", 30*time.Second, "How long to let in-flight requests finish when shutting down")
 
 	return cmd
 }
@@ -1,5 +1,10 @@
 package rmqhttp
 
+import (
+	"context"
+	"time"
+)
+
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -14,15 +19,42 @@ var rootCmd = &cobra.Command{
 }
 
 func Execute() {
+	var logLevel, logFormat, traceExporter string
+	shutdownTracing := func(context.Context) error { return nil }
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "debug", "Least severe level to log; one of panic, fatal, error, warn, info, debug, or trace")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "How to format log lines; text or json")
+	rootCmd.PersistentFlags().StringVar(&traceExporter, "trace-exporter", "none", "Where to send trace spans; none, stdout, otlp-grpc, or otlp-http")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if err := configureLogging(logLevel, logFormat); err != nil {
+			return err
+		}
+
+		shutdown, err := configureTracing(cmd.Context(), traceExporter)
+		if err != nil {
+			return err
+		}
+
+		shutdownTracing = shutdown
+		return nil
+	}
+
 	rootCmd.AddCommand(mkProduceCmd())
 	rootCmd.AddCommand(mkConsumeCmd())
 	rootCmd.AddCommand(mkInitCmd())
 	rootCmd.AddCommand(mkDestroyCmd())
+	rootCmd.AddCommand(mkDlqCmd())
 	rootCmd.AddCommand(mkVersionCmd())
 
-	log.SetLevel(log.DebugLevel)
+	err := rootCmd.Execute()
+
+	// Spans that are still buffered would be lost on exit.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if shutdownErr := shutdownTracing(ctx); shutdownErr != nil {
+		log.Warnf("Failed to flush traces: %s", shutdownErr)
+	}
 
-	if err := rootCmd.Execute(); err != nil {
+	if err != nil {
 		log.Fatal(err)
 	}
 }
@@ -1,11 +1,23 @@
 package rmqhttp
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 import (
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+import (
+	"github.com/Eagerod/rmqhttp/pkg/rmqhttp"
 )
 
 func getConnectionString() string {
@@ -27,3 +39,107 @@ func getManagementConnectionString() string {
 
 	return s
 }
+
+// Reads the options for connecting to RMQ over TLS from the environment.
+// Returns nil when none are given, in which case amqps:// connection strings
+// still work, using the system's CAs.
+func getAmqpTLSConfig() (*tls.Config, error) {
+	options := rmqhttp.AmqpTLSOptions{
+		CaFile:     os.Getenv("RABBITMQ_TLS_CA_FILE"),
+		CertFile:   os.Getenv("RABBITMQ_TLS_CERT_FILE"),
+		KeyFile:    os.Getenv("RABBITMQ_TLS_KEY_FILE"),
+		ServerName: os.Getenv("RABBITMQ_TLS_SERVER_NAME"),
+	}
+
+	if options.IsEmpty() {
+		return nil, nil
+	}
+
+	return rmqhttp.NewAmqpTLSConfig(options)
+}
+
+// Blocks until the process is asked to stop, then returns a context that
+// expires once the grace period for shutting down has elapsed.
+func waitForShutdown(gracePeriod time.Duration) (context.Context, context.CancelFunc) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	log.Infof("Received %s; shutting down within %s", sig, gracePeriod)
+	return context.WithTimeout(context.Background(), gracePeriod)
+}
+
+func configureLogging(level, format string) error {
+	logLevel, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+
+	log.SetLevel(logLevel)
+
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	return nil
+}
+
+// Returns nil when the server shouldn't use TLS.
+// The certificate is reloaded when its files change, so it can be renewed
+// without a restart.
+// Client certificates are asked for, but not required, when a client CA is
+// given, so other kinds of credentials can still be used.
+func serverTlsConfig(certPath, keyPath, clientCaPath string) (*tls.Config, error) {
+	if (certPath == "") != (keyPath == "") {
+		return nil, fmt.Errorf("--tls-cert and --tls-key must be given together")
+	}
+
+	if certPath == "" {
+		if clientCaPath != "" {
+			return nil, fmt.Errorf("--client-ca needs --tls-cert")
+		}
+
+		return nil, nil
+	}
+
+	reloader, err := rmqhttp.NewCertificateReloader(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if clientCaPath != "" {
+		pem, err := os.ReadFile(clientCaPath)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", clientCaPath)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config, nil
+}
+
+func addEndpointPolicyFlags(cmd *cobra.Command, config *rmqhttp.EndpointPolicyConfig) {
+	cmd.Flags().StringSliceVar(&config.Schemes, "allow-scheme", nil, "URL scheme tasks may be sent to; may be repeated (default http,https)")
+	cmd.Flags().StringSliceVar(&config.AllowedHosts, "allow-host", nil, "Host or pattern tasks may be sent to; all hosts are allowed if none are given")
+	cmd.Flags().StringSliceVar(&config.DeniedHosts, "deny-host", nil, "Host or pattern tasks may never be sent to")
+	cmd.Flags().StringSliceVar(&config.AllowedNetworks, "allow-cidr", nil, "Network endpoints must resolve into, like 203.0.113.0/24; takes precedence over --block-private")
+	cmd.Flags().StringSliceVar(&config.DeniedNetworks, "deny-cidr", nil, "Network endpoints may never resolve into")
+	cmd.Flags().BoolVar(&config.BlockPrivate, "block-private", false, "Refuse endpoints that resolve to loopback, private, or link-local addresses, or that don't resolve; off by default, so endpoints on internal networks are allowed")
+}
@@ -0,0 +1,344 @@
+package rmqhttp
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Header naming the key an HMAC-signed request was signed with; the signature
+// itself goes in SignatureHeaderName, the same way the worker signs its
+// requests.
+const KeyIdHeaderName = "X-Rmqhttp-Key-Id"
+
+var ErrNoCredentials = errors.New("no credentials given")
+var ErrUnknownCredentials = errors.New("unknown credentials")
+var ErrSignatureReplayed = errors.New("signature already used")
+
+// Describes one credential, and what it may be used for.
+// Exactly one of Token or TokenEnv for a bearer token, HmacSecret or
+// HmacSecretEnv for HMAC-signed requests, or ClientCommonName for an mTLS
+// client certificate must be given.
+// The *Env fields name environment variables holding the secret.
+// Queues and Hosts are patterns, as understood by path.Match, of the queues
+// and endpoint hosts the credential may enqueue tasks for; at least one of
+// each is needed, and "*" allows all of them.
+type CredentialConfig struct {
+	Name             string
+	Token            string
+	TokenEnv         string
+	HmacSecret       string
+	HmacSecretEnv    string
+	ClientCommonName string
+	Queues           []string
+	Hosts            []string
+}
+
+// Contents of the file given to the server's --auth-config flag.
+type AuthConfig struct {
+	Credentials []CredentialConfig
+}
+
+type Credential struct {
+	Name   string
+	Queues []string
+	Hosts  []string
+}
+
+func (c *Credential) AllowsQueue(queueName string) bool {
+	return matchesAny(c.Queues, queueName)
+}
+
+func (c *Credential) AllowsEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+
+	return c.AllowsHost(u.Hostname())
+}
+
+func (c *Credential) AllowsHost(host string) bool {
+	return matchesAny(c.Hosts, strings.ToLower(host))
+}
+
+// Whether the credential was given "*" for both its queues and hosts.
+// Requests that can't be tied to a single queue and host, like cancelling a
+// task by its ID, need it.
+func (c *Credential) HasFullAccess() bool {
+	return c.allowsEverything(c.Queues) && c.allowsEverything(c.Hosts)
+}
+
+func (c *Credential) allowsEverything(patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Identifies the credential a request was made with.
+// Bearer tokens are checked first, then HMAC signatures, then verified
+// client certificates.
+// Each HMAC signature is only accepted once while its timestamp is within
+// DefaultSignatureTolerance, so a captured request can't be sent again; this
+// means identical requests signed in the same second are refused after the
+// first. Signatures are only remembered by the server that saw them, so a
+// request can still be replayed against other replicas.
+type Authenticator struct {
+	names       map[string]bool
+	tokens      map[string]*Credential
+	hmacSecrets map[string][]byte
+	hmacKeys    map[string]*Credential
+	commonNames map[string]*Credential
+
+	// Signatures that have been accepted, and when they can be forgotten.
+	seenLock       sync.Mutex
+	seenSignatures map[string]time.Time
+	lastPrune      time.Time
+}
+
+func NewAuthenticator(config AuthConfig) (*Authenticator, error) {
+	a := Authenticator{
+		names:          map[string]bool{},
+		tokens:         map[string]*Credential{},
+		hmacSecrets:    map[string][]byte{},
+		hmacKeys:       map[string]*Credential{},
+		commonNames:    map[string]*Credential{},
+		seenSignatures: map[string]time.Time{},
+	}
+
+	for _, cc := range config.Credentials {
+		if err := a.add(cc); err != nil {
+			return nil, err
+		}
+	}
+
+	return &a, nil
+}
+
+func (a *Authenticator) add(cc CredentialConfig) error {
+	if cc.Name == "" {
+		return fmt.Errorf("credential name must not be empty")
+	}
+
+	if a.names[cc.Name] {
+		return fmt.Errorf("credential %s is given more than once", cc.Name)
+	}
+
+	if len(cc.Queues) == 0 || len(cc.Hosts) == 0 {
+		return fmt.Errorf("credential %s must be scoped to at least one queue and host", cc.Name)
+	}
+
+	for _, pattern := range append(append([]string{}, cc.Queues...), cc.Hosts...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q in credential %s: %w", pattern, cc.Name, err)
+		}
+	}
+
+	credential := &Credential{Name: cc.Name, Queues: cc.Queues, Hosts: cc.Hosts}
+
+	token, err := secretFromConfig(cc.Token, cc.TokenEnv)
+	if err != nil {
+		return fmt.Errorf("credential %s: %w", cc.Name, err)
+	}
+
+	hmacSecret, err := secretFromConfig(cc.HmacSecret, cc.HmacSecretEnv)
+	if err != nil {
+		return fmt.Errorf("credential %s: %w", cc.Name, err)
+	}
+
+	kinds := 0
+	for _, given := range []bool{token != "", hmacSecret != "", cc.ClientCommonName != ""} {
+		if given {
+			kinds++
+		}
+	}
+
+	if kinds != 1 {
+		return fmt.Errorf("credential %s must give exactly one of a token, an HMAC secret, or a client common name", cc.Name)
+	}
+
+	// Credentials that share a secret couldn't be told apart.
+	switch {
+	case token != "":
+		if _, ok := a.tokens[token]; ok {
+			return fmt.Errorf("credential %s has the same token as another credential", cc.Name)
+		}
+		a.tokens[token] = credential
+	case hmacSecret != "":
+		a.hmacSecrets[cc.Name] = []byte(hmacSecret)
+		a.hmacKeys[cc.Name] = credential
+	default:
+		if _, ok := a.commonNames[cc.ClientCommonName]; ok {
+			return fmt.Errorf("credential %s has the same client common name as another credential", cc.Name)
+		}
+		a.commonNames[cc.ClientCommonName] = credential
+	}
+
+	a.names[cc.Name] = true
+	return nil
+}
+
+func secretFromConfig(value, envName string) (string, error) {
+	if value != "" && envName != "" {
+		return "", fmt.Errorf("a secret and an environment variable can't both be given")
+	}
+
+	if envName == "" {
+		return value, nil
+	}
+
+	value = os.Getenv(envName)
+	if value == "" {
+		return "", fmt.Errorf("environment variable %s is empty", envName)
+	}
+
+	return value, nil
+}
+
+// Whether any client certificate credentials are configured, in which case
+// the server needs to ask for client certificates.
+func (a *Authenticator) UsesClientCertificates() bool {
+	return len(a.commonNames) != 0
+}
+
+func (a *Authenticator) Authenticate(r *http.Request) (*Credential, error) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return nil, ErrUnknownCredentials
+		}
+		token := strings.TrimPrefix(authorization, "Bearer ")
+
+		// Every token is compared, so timing doesn't give away how much of
+		//   one was right.
+		var found *Credential
+		for candidate, credential := range a.tokens {
+			if subtle.ConstantTimeCompare([]byte(candidate), []byte(token)) == 1 {
+				found = credential
+			}
+		}
+
+		if found == nil {
+			return nil, ErrUnknownCredentials
+		}
+
+		return found, nil
+	}
+
+	if keyId := r.Header.Get(KeyIdHeaderName); keyId != "" {
+		secret, ok := a.hmacSecrets[keyId]
+		if !ok {
+			return nil, ErrUnknownCredentials
+		}
+
+		signature, err := verifyRequest(r, secret, DefaultSignatureTolerance)
+		if err != nil {
+			return nil, err
+		}
+
+		if !a.firstUse(keyId+"\x00"+signature, time.Now()) {
+			return nil, ErrSignatureReplayed
+		}
+
+		return a.hmacKeys[keyId], nil
+	}
+
+	// Only certificates that chain to the configured CAs are considered.
+	if r.TLS != nil && len(r.TLS.VerifiedChains) != 0 {
+		credential, ok := a.commonNames[r.TLS.VerifiedChains[0][0].Subject.CommonName]
+		if !ok {
+			return nil, ErrUnknownCredentials
+		}
+
+		return credential, nil
+	}
+
+	return nil, ErrNoCredentials
+}
+
+// Records a signature, and returns whether it hadn't been seen before.
+// Timestamps may be up to the tolerance ahead of the clock, so signatures are
+// kept for twice that.
+func (a *Authenticator) firstUse(signature string, now time.Time) bool {
+	a.seenLock.Lock()
+	defer a.seenLock.Unlock()
+
+	if now.Sub(a.lastPrune) > DefaultSignatureTolerance {
+		for seen, expiry := range a.seenSignatures {
+			if now.After(expiry) {
+				delete(a.seenSignatures, seen)
+			}
+		}
+		a.lastPrune = now
+	}
+
+	if expiry, ok := a.seenSignatures[signature]; ok && !now.After(expiry) {
+		return false
+	}
+
+	a.seenSignatures[signature] = now.Add(2 * DefaultSignatureTolerance)
+	return true
+}
+
+type credentialContextKey struct{}
+
+// Rejects requests that can't be authenticated, and makes the credential of
+// those that can available to handlers through CredentialFromContext.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential, err := a.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.Header()["Content-Type"] = []string{"application/json"}
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write(NewJsonError(http.StatusText(http.StatusUnauthorized), err.Error()).Json())
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), credentialContextKey{}, credential)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Returns nil when the request wasn't authenticated, which is the case for
+// every request when no authenticator is in use.
+func CredentialFromContext(ctx context.Context) *Credential {
+	credential, _ := ctx.Value(credentialContextKey{}).(*Credential)
+	return credential
+}
+
+func LoadAuthConfig(filename string) (*AuthConfig, error) {
+	bytes, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := AuthConfig{}
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %w", filename, err)
+	}
+
+	return &config, nil
+}
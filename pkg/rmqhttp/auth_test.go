@@ -0,0 +1,288 @@
+package rmqhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func testAuthenticator(t *testing.T) *Authenticator {
+	a, err := NewAuthenticator(AuthConfig{Credentials: []CredentialConfig{
+		{Name: "token", Token: "abc", Queues: []string{"q"}, Hosts: []string{"*.example.com"}},
+		{Name: "hmac", HmacSecret: "secret", Queues: []string{"*"}, Hosts: []string{"*"}},
+		{Name: "cert", ClientCommonName: "client", Queues: []string{"q-*"}, Hosts: []string{"example.org"}},
+	}})
+	assert.NoError(t, err)
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := testAuthenticator(t)
+
+	signed := httptest.NewRequest("POST", "http://bridge/queues/q", strings.NewReader("{}"))
+	signed.Header.Set(KeyIdHeaderName, "hmac")
+	signed.Header.Set(SignatureHeaderName, SignatureHeader([]byte("secret"), "POST", "http://bridge/queues/q", time.Now(), []byte("{}")))
+
+	badlySigned := httptest.NewRequest("POST", "http://bridge/queues/q", strings.NewReader("{}"))
+	badlySigned.Header.Set(KeyIdHeaderName, "hmac")
+	badlySigned.Header.Set(SignatureHeaderName, SignatureHeader([]byte("wrong"), "POST", "http://bridge/queues/q", time.Now(), []byte("{}")))
+
+	signedNoPath := httptest.NewRequest("POST", "http://bridge:8080", strings.NewReader("{}"))
+	signedNoPath.Header.Set(KeyIdHeaderName, "hmac")
+	signedNoPath.Header.Set(SignatureHeaderName, SignatureHeader([]byte("secret"), "POST", "http://bridge:8080", time.Now(), []byte("{}")))
+
+	withCert := httptest.NewRequest("POST", "https://bridge/", nil)
+	withCert.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: "client"}}}}}
+
+	var tests = []struct {
+		name       string
+		request    *http.Request
+		headers    map[string]string
+		credential string
+		err        error
+	}{
+		{"Bearer", httptest.NewRequest("POST", "/", nil), map[string]string{"Authorization": "Bearer abc"}, "token", nil},
+		{"Wrong Bearer", httptest.NewRequest("POST", "/", nil), map[string]string{"Authorization": "Bearer abd"}, "", ErrUnknownCredentials},
+		{"Basic", httptest.NewRequest("POST", "/", nil), map[string]string{"Authorization": "Basic abc"}, "", ErrUnknownCredentials},
+		{"Signed", signed, nil, "hmac", nil},
+		{"Signed Without Path", signedNoPath, nil, "hmac", nil},
+		{"Badly Signed", badlySigned, nil, "", ErrInvalidSignature},
+		{"Unknown Key", httptest.NewRequest("POST", "/", nil), map[string]string{KeyIdHeaderName: "other"}, "", ErrUnknownCredentials},
+		{"Client Certificate", withCert, nil, "cert", nil},
+		{"Nothing", httptest.NewRequest("POST", "/", nil), nil, "", ErrNoCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for key, value := range tt.headers {
+				tt.request.Header.Set(key, value)
+			}
+
+			credential, err := a.Authenticate(tt.request)
+			assert.Equal(t, tt.err, err)
+			if tt.err == nil {
+				assert.Equal(t, tt.credential, credential.Name)
+			}
+		})
+	}
+}
+
+func TestCredentialScope(t *testing.T) {
+	c := Credential{Name: "c", Queues: []string{"q", "jobs-*"}, Hosts: []string{"*.example.com"}}
+
+	assert.True(t, c.AllowsQueue("q"))
+	assert.True(t, c.AllowsQueue("jobs-a"))
+	assert.False(t, c.AllowsQueue("other"))
+
+	assert.True(t, c.AllowsEndpoint("https://API.example.com:8443/hook"))
+	assert.False(t, c.AllowsEndpoint("https://example.com/hook"))
+	assert.False(t, c.AllowsEndpoint("http://169.254.169.254/"))
+}
+
+func TestNewAuthenticatorInvalid(t *testing.T) {
+	var tests = []struct {
+		name   string
+		config CredentialConfig
+	}{
+		{"No Name", CredentialConfig{Token: "t", Queues: []string{"*"}, Hosts: []string{"*"}}},
+		{"No Queues", CredentialConfig{Name: "c", Token: "t", Hosts: []string{"*"}}},
+		{"No Hosts", CredentialConfig{Name: "c", Token: "t", Queues: []string{"*"}}},
+		{"No Kind", CredentialConfig{Name: "c", Queues: []string{"*"}, Hosts: []string{"*"}}},
+		{"Two Kinds", CredentialConfig{Name: "c", Token: "t", HmacSecret: "s", Queues: []string{"*"}, Hosts: []string{"*"}}},
+		{"Empty Env", CredentialConfig{Name: "c", TokenEnv: "TEST_AUTH_TOKEN_UNSET", Queues: []string{"*"}, Hosts: []string{"*"}}},
+		{"Bad Pattern", CredentialConfig{Name: "c", Token: "t", Queues: []string{"["}, Hosts: []string{"*"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(AuthConfig{Credentials: []CredentialConfig{tt.config}})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewAuthenticatorDuplicates(t *testing.T) {
+	var tests = []struct {
+		name    string
+		configs []CredentialConfig
+	}{
+		{"Name", []CredentialConfig{
+			{Name: "c", Token: "t", Queues: []string{"*"}, Hosts: []string{"*"}},
+			{Name: "c", HmacSecret: "s", Queues: []string{"*"}, Hosts: []string{"*"}},
+		}},
+		{"Token", []CredentialConfig{
+			{Name: "a", Token: "t", Queues: []string{"q"}, Hosts: []string{"*"}},
+			{Name: "b", Token: "t", Queues: []string{"*"}, Hosts: []string{"*"}},
+		}},
+		{"Client Common Name", []CredentialConfig{
+			{Name: "a", ClientCommonName: "client", Queues: []string{"q"}, Hosts: []string{"*"}},
+			{Name: "b", ClientCommonName: "client", Queues: []string{"*"}, Hosts: []string{"*"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(AuthConfig{Credentials: tt.configs})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAuthenticateReplayedSignature(t *testing.T) {
+	a := testAuthenticator(t)
+	header := SignatureHeader([]byte("secret"), "POST", "http://bridge/queues/q", time.Now(), []byte("{}"))
+
+	signed := func() *http.Request {
+		r := httptest.NewRequest("POST", "http://bridge/queues/q", strings.NewReader("{}"))
+		r.Header.Set(KeyIdHeaderName, "hmac")
+		r.Header.Set(SignatureHeaderName, header)
+		return r
+	}
+
+	credential, err := a.Authenticate(signed())
+	assert.NoError(t, err)
+	assert.Equal(t, "hmac", credential.Name)
+
+	_, err = a.Authenticate(signed())
+	assert.Equal(t, ErrSignatureReplayed, err)
+}
+
+func TestAuthenticatorFirstUse(t *testing.T) {
+	a := testAuthenticator(t)
+	now := time.Now()
+
+	assert.True(t, a.firstUse("sig", now))
+	assert.False(t, a.firstUse("sig", now.Add(2*DefaultSignatureTolerance)))
+	assert.True(t, a.firstUse("other", now))
+
+	// Forgotten once its timestamp could no longer be accepted.
+	assert.True(t, a.firstUse("sig", now.Add(2*DefaultSignatureTolerance+time.Second)))
+
+	assert.True(t, a.firstUse("new", now.Add(5*DefaultSignatureTolerance)))
+	assert.Len(t, a.seenSignatures, 1)
+}
+
+func TestAuthenticatorMiddleware(t *testing.T) {
+	a := testAuthenticator(t)
+
+	var seen *Credential
+	handler := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = CredentialFromContext(r.Context())
+	}))
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, httptest.NewRequest("POST", "/", nil))
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	jsonError := JsonError{}
+	assert.NoError(t, json.Unmarshal(rw.Body.Bytes(), &jsonError))
+	assert.Equal(t, ErrNoCredentials.Error(), jsonError.Message)
+	assert.Nil(t, seen)
+
+	rw = httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", "Bearer abc")
+	handler.ServeHTTP(rw, r)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "token", seen.Name)
+}
+
+func withCredential(r *http.Request, credential *Credential) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), credentialContextKey{}, credential))
+}
+
+func TestCancelTaskHandlerScope(t *testing.T) {
+	hc := NewHttpController()
+
+	var tests = []struct {
+		name       string
+		credential *Credential
+		statusCode int
+	}{
+		{"Scoped To Queue", &Credential{Name: "c", Queues: []string{"a"}, Hosts: []string{"*"}}, http.StatusForbidden},
+		{"Scoped To Host", &Credential{Name: "c", Queues: []string{"*"}, Hosts: []string{"example.com"}}, http.StatusForbidden},
+		// Not connected, so getting as far as cancelling fails.
+		{"Full Access", &Credential{Name: "c", Queues: []string{"*"}, Hosts: []string{"*"}}, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("DELETE", "/tasks/id", nil)
+			r = mux.SetURLVars(r, map[string]string{TaskIdRouteVariable: "id"})
+
+			rw := httptest.NewRecorder()
+			hc.CancelTaskHandler(rw, withCredential(r, tt.credential))
+			assert.Equal(t, tt.statusCode, rw.Code)
+		})
+	}
+}
+
+func TestProcessDeadLettersScope(t *testing.T) {
+	hc := NewHttpController()
+
+	var tests = []struct {
+		name       string
+		credential *Credential
+		query      string
+		statusCode int
+	}{
+		{"Other Queue", &Credential{Name: "c", Queues: []string{"other"}, Hosts: []string{"*"}}, "", http.StatusForbidden},
+		{"Host Scoped Without Host", &Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*.example.com"}}, "", http.StatusForbidden},
+		{"Host Scoped Other Host", &Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*.example.com"}}, "?host=example.org", http.StatusForbidden},
+		// Not connected, so getting as far as the DLQ fails.
+		{"Host Scoped With Host", &Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*.example.com"}}, "?host=api.example.com", http.StatusInternalServerError},
+		{"All Hosts", &Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*"}}, "", http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		for _, handler := range []http.HandlerFunc{hc.ReplayDeadLettersHandler, hc.PurgeDeadLettersHandler} {
+			t.Run(tt.name, func(t *testing.T) {
+				r := httptest.NewRequest("POST", "/queues/q/dlq/purge"+tt.query, nil)
+				r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+
+				rw := httptest.NewRecorder()
+				handler(rw, withCredential(r, tt.credential))
+				assert.Equal(t, tt.statusCode, rw.Code)
+			})
+		}
+	}
+}
+
+func TestQueueInspectionScope(t *testing.T) {
+	hc := NewHttpController()
+
+	var tests = []struct {
+		name       string
+		credential *Credential
+		statusCode int
+	}{
+		{"Host Scoped", &Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*.example.com"}}, http.StatusForbidden},
+		// Not connected, so getting as far as the queue fails.
+		{"All Hosts", &Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*"}}, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		for _, handler := range []http.HandlerFunc{hc.StatsHandler, hc.DeadLetterAlertHandler} {
+			t.Run(tt.name, func(t *testing.T) {
+				r := httptest.NewRequest("GET", "/queues/q/stats", nil)
+				r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+
+				rw := httptest.NewRecorder()
+				handler(rw, withCredential(r, tt.credential))
+				assert.Equal(t, tt.statusCode, rw.Code)
+			})
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package rmqhttp
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Stream that every cancelled task ID is appended to, so every worker can
+// replay the full set of cancellations no matter when it started.
+const CancellationStreamName = "rmqhttp-cancellations"
+
+// How long cancellations are kept; tasks scheduled further out than this can
+// only be cancelled within this long of their delivery.
+const CancellationRetention = 30 * 24 * time.Hour
+
+var ErrCancellationsDisabled = errors.New("cancelling tasks is disabled")
+
+// Records which tasks have been cancelled.
+// The server appends to the stream, and workers follow it to keep an
+// in-memory set of cancelled task IDs to check deliveries against.
+// A nil store has cancellations disabled; nothing is ever cancelled, and
+// Cancel fails with ErrCancellationsDisabled.
+type CancellationStore struct {
+	rmq *RMQ
+
+	lock       sync.RWMutex
+	cancelled  map[string]time.Time
+	lastPruned time.Time
+}
+
+func NewCancellationStore(rmq *RMQ) *CancellationStore {
+	store := CancellationStore{
+		rmq:        rmq,
+		cancelled:  make(map[string]time.Time),
+		lastPruned: time.Now(),
+	}
+	return &store
+}
+
+// Fails on brokers older than RabbitMQ 3.9, which don't have streams.
+func (cs *CancellationStore) Prepare() error {
+	return cs.rmq.DeclareStream(CancellationStreamName, CancellationRetention)
+}
+
+func (cs *CancellationStore) Cancel(taskId string) error {
+	if cs == nil {
+		return ErrCancellationsDisabled
+	}
+
+	err := cs.rmq.Publish(
+		"",
+		CancellationStreamName,
+		amqp.Publishing{
+			ContentType:  "text/plain",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			Body:         []byte(taskId),
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	cs.record(taskId, time.Now())
+	return nil
+}
+
+func (cs *CancellationStore) IsCancelled(taskId string) bool {
+	if cs == nil {
+		return false
+	}
+
+	cs.lock.RLock()
+	defer cs.lock.RUnlock()
+	_, ok := cs.cancelled[taskId]
+	return ok
+}
+
+// Keeps the in-memory set up to date with the stream until the RMQ is closed.
+func (cs *CancellationStore) Follow() {
+	if cs == nil {
+		return
+	}
+
+	cs.rmq.FollowStream(CancellationStreamName, func(delivery amqp.Delivery) {
+		cs.record(string(delivery.Body), deliveryTimestamp(delivery))
+	})
+}
+
+// Also drops cancellations that have aged out of the stream, at most once an
+// hour.
+func (cs *CancellationStore) record(taskId string, cancelledAt time.Time) {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	cs.cancelled[taskId] = cancelledAt
+
+	now := time.Now()
+	if now.Sub(cs.lastPruned) < time.Hour {
+		return
+	}
+
+	for taskId, cancelledAt := range cs.cancelled {
+		if now.Sub(cancelledAt) > CancellationRetention {
+			delete(cs.cancelled, taskId)
+		}
+	}
+	cs.lastPruned = now
+}
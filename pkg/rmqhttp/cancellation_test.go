@@ -0,0 +1,32 @@
+package rmqhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancellationStoreDisabled(t *testing.T) {
+	var cs *CancellationStore
+
+	assert.False(t, cs.IsCancelled("id"))
+	assert.ErrorIs(t, cs.Cancel("id"), ErrCancellationsDisabled)
+	cs.Follow()
+}
+
+func TestCancelTaskHandlerDisabled(t *testing.T) {
+	hc := NewHttpController()
+	hc.SetCancellationsEnabled(false)
+
+	r := httptest.NewRequest("DELETE", "/tasks/id", nil)
+	r = mux.SetURLVars(r, map[string]string{TaskIdRouteVariable: "id"})
+
+	rw := httptest.NewRecorder()
+	hc.CancelTaskHandler(rw, r)
+	assert.Equal(t, http.StatusNotImplemented, rw.Code)
+}
@@ -1,7 +1,11 @@
 package rmqhttp
 
 import (
+	"context"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -12,103 +16,475 @@ import (
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func ConsumeOne(rmq *RMQ, delivery amqp.Delivery, queue *amqp.Queue) {
+func (w *Worker) ConsumeOne(delivery amqp.Delivery, queue *amqp.Queue) {
+	logger := deliveryLogger(queue, &delivery)
 	payload, err := NewRMQPayload(delivery.Body)
 	if err != nil {
 		// This is unrecoverable; don't even obey the retry count.
 		// Ship this straight to the DLQ.
-		log.Error(err)
-		delivery.Nack(false, false)
+		logger.WithError(err).Error("Invalid payload")
+		w.rmq.DeadLetter(queue, &delivery, "invalid payload", NewDeliveryFailure(0, err.Error(), nil))
 		return
 	}
 
-	var httpBodyReader io.Reader = strings.NewReader(payload.Content)
-	if payload.Base64Decode {
-		httpBodyReader = base64.NewDecoder(base64.StdEncoding, httpBodyReader)
+	if delivery.MessageId != "" && w.cancellations.IsCancelled(delivery.MessageId) {
+		logger.Info("Task was cancelled. Dropping it.")
+		delivery.Ack(false)
+		return
+	}
+
+	logger = logger.WithField(endpointLogField, payload.Endpoint)
+
+	if err := w.endpointPolicy.CheckURL(payload.Endpoint); err != nil {
+		logger.WithError(err).Warn("Endpoint not allowed. Sending to DLX.")
+		w.rmq.DeadLetter(queue, &delivery, "endpoint not allowed", NewDeliveryFailure(0, err.Error(), nil))
+		return
 	}
 
+	// Each attempt is its own span, under the span that enqueued the task.
+	// Requests are made under the worker's context, so that they're abandoned
+	//   if they run past the shutdown deadline.
+	attempt, _ := ToInt(delivery.Headers[attemptsHeaderName])
+	ctx, span := tracer.Start(traceContextFromDelivery(w.ctx, &delivery), "rmqhttp.deliver",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			queueTraceAttribute.String(queue.Name),
+			taskIdTraceAttribute.String(delivery.MessageId),
+			attemptTraceAttribute.Int(attempt+1),
+			endpointTraceAttribute.String(payload.Endpoint),
+			methodTraceAttribute.String(payload.Method),
+		),
+	)
+	defer span.End()
+
 	client := &http.Client{
-		Timeout: time.Second * time.Duration(payload.Timeout),
+		Transport: w.transport,
+		Timeout:   time.Second * time.Duration(payload.Timeout),
+	}
+	if w.endpointPolicy != nil {
+		client.CheckRedirect = w.endpointPolicy.CheckRedirect
+	}
+	req, err := http.NewRequestWithContext(ctx, payload.Method, payload.Endpoint, nil)
+	if err != nil {
+		failSpan(span, err)
+		logger.WithError(err).Error("Invalid request")
+		w.rmq.DeadLetter(queue, &delivery, "invalid request", NewDeliveryFailure(0, err.Error(), nil))
+		return
+	}
+
+	// Methods like GET generally don't carry a body, so only attach one if
+	//   there's something to send.
+	if payload.Content != "" {
+		var httpBodyReader io.Reader = strings.NewReader(payload.Content)
+		if payload.Base64Decode {
+			httpBodyReader = base64.NewDecoder(base64.StdEncoding, httpBodyReader)
+		}
+
+		req.Body = io.NopCloser(httpBodyReader)
 	}
-	req, _ := http.NewRequest("POST", payload.Endpoint, nil)
-	req.Body = io.NopCloser(httpBodyReader)
 
 	for key, value := range payload.Headers {
 		req.Header.Add(key, value)
 	}
 
+	idempotencyKey, _ := delivery.Headers[idempotencyKeyAmqpHeaderName].(string)
+	if idempotencyKey == "" {
+		idempotencyKey = payload.IdempotencyKey
+	}
+
+	if idempotencyKey != "" && req.Header.Get(IdempotencyKeyHeaderName) == "" {
+		req.Header.Set(IdempotencyKeyHeaderName, idempotencyKey)
+	}
+
+	injectTraceContextIntoRequest(ctx, req)
+
+	if secret := w.signingSecrets.SecretFor(queue.Name, payload.Endpoint); secret != nil {
+		// The signature covers the decoded body, so it has to be read up
+		//   front.
+		if err := signRequest(req, secret, time.Now()); err != nil {
+			failSpan(span, err)
+			logger.WithError(err).Error("Invalid content")
+			w.rmq.DeadLetter(queue, &delivery, "invalid payload", NewDeliveryFailure(0, err.Error(), nil))
+			return
+		}
+	}
+
+	host := endpointHost(payload.Endpoint, w.metricsHosts)
+	deliveryAttemptsTotal.WithLabelValues(queue.Name, host).Inc()
+
 	requestStartTime := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
 		requestDuration := time.Since(requestStartTime)
-		log.Debugf("HTTP fail in %05dms from %s\n  %s", requestDuration.Milliseconds(), payload.Endpoint, err.Error())
-		rmq.RequeueOrNack(queue, &delivery)
+		deliveryDuration.WithLabelValues(host).Observe(requestDuration.Seconds())
+		deliveryOutcomesTotal.WithLabelValues(queue.Name, host, statusClass(0)).Inc()
+		failSpan(span, err)
+		logger.WithError(err).WithField(durationLogField, requestDuration.Milliseconds()).Debug("HTTP request failed")
+		if w.ctx.Err() != nil {
+			// The endpoint never got to answer, so this attempt doesn't
+			//   count against the task's retries.
+			logger.Warn("Abandoned request at shutdown. Returning task to the queue.")
+			delivery.Nack(false, true)
+			return
+		}
+
+		if errors.Is(err, ErrEndpointNotAllowed) {
+			w.rmq.DeadLetter(queue, &delivery, "endpoint not allowed", NewDeliveryFailure(0, err.Error(), nil))
+			return
+		}
+
+		w.rmq.RequeueOrNack(queue, &delivery, NewDeliveryFailure(0, err.Error(), nil))
 		return
 	}
 	defer resp.Body.Close()
 
 	body, _ := io.ReadAll(resp.Body)
 	requestDuration := time.Since(requestStartTime)
+	deliveryDuration.WithLabelValues(host).Observe(requestDuration.Seconds())
+	deliveryOutcomesTotal.WithLabelValues(queue.Name, host, statusClass(resp.StatusCode)).Inc()
+	logger = logger.WithFields(log.Fields{
+		statusLogField:   resp.StatusCode,
+		durationLogField: requestDuration.Milliseconds(),
+	})
 	if len(body) == 0 {
-		log.Debugf("HTTP %d in %05dms from %s", resp.StatusCode, requestDuration.Milliseconds(), payload.Endpoint)
+		logger.Debug("HTTP request completed")
 	} else {
-		log.Debugf("HTTP %d in %05dms from %s\n  %s", resp.StatusCode, requestDuration.Milliseconds(), payload.Endpoint, body)
+		logger.WithField("response", truncateResponse(body)).Debug("HTTP request completed")
 	}
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		rmq.RequeueOrNack(queue, &delivery)
+	span.SetAttributes(statusTraceAttribute.Int(resp.StatusCode))
+	failure := NewDeliveryFailure(resp.StatusCode, fmt.Sprintf("HTTP %d from %s", resp.StatusCode, payload.Endpoint), body)
+	outcome := w.statusPolicy.ForPayload(payload).Outcome(resp.StatusCode)
+	if outcome != StatusSuccess {
+		failSpan(span, fmt.Errorf("HTTP %d", resp.StatusCode))
+	}
+
+	switch outcome {
+	case StatusRetry:
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			if delay, ok := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+				logger.Debugf("Retrying after %ds, as requested by Retry-After", delay)
+				w.rmq.RequeueOrNackAfter(queue, &delivery, delay, failure)
+				return
+			}
+		}
+
+		w.rmq.RequeueOrNack(queue, &delivery, failure)
+		return
+	case StatusDeadLetter:
+		logger.Info("Status is not retryable. Sending to DLX.")
+		w.rmq.DeadLetter(queue, &delivery, "status not retryable", failure)
 		return
 	}
 
 	delivery.Ack(false)
 }
 
-func ConsumeQueue(connectionString, queueName string, consumers int) {
+// Runs consumers for several queues on a single shared RMQ connection.
+type Worker struct {
+	rmq           *RMQ
+	queues        []QueueConfig
+	cancellations *CancellationStore
+
+	statusPolicy StatusPolicy
+
+	signingSecrets *SigningSecrets
+
+	endpointPolicy *EndpointPolicy
+	transport      http.RoundTripper
+
+	listenAddress string
+	server        *http.Server
+	metricsHosts  map[string]bool
+
+	// Cancelled once the shutdown deadline passes, abandoning any requests
+	//   that are still being made.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// Closed once Shutdown is done, so that Run returns even if consumers
+	//   are still stuck.
+	shutdown chan struct{}
+
+	consumers sync.WaitGroup
+
+	// Channels of the consumers that are currently registered, keyed by
+	//   consumer tag, so they can be cancelled on shutdown.
+	consumerLock     sync.Mutex
+	consumerChannels map[string]*amqp.Channel
+	consumerCount    int
+	stopping         bool
+}
+
+func NewWorker(queues []QueueConfig) *Worker {
 	rmq := NewRMQ()
-	if err := rmq.ConnectRMQ(connectionString); err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	worker := Worker{
+		rmq:              rmq,
+		queues:           queues,
+		cancellations:    NewCancellationStore(rmq),
+		statusPolicy:     DefaultStatusPolicy(),
+		transport:        http.DefaultTransport,
+		ctx:              ctx,
+		cancel:           cancel,
+		shutdown:         make(chan struct{}),
+		consumerChannels: make(map[string]*amqp.Channel),
 	}
+	return &worker
+}
 
-	queue, err := rmq.PrepareQueue(queueName)
-	if err != nil {
-		log.Fatal(err)
+// Sets the status codes used for tasks that don't give their own.
+func (w *Worker) SetStatusPolicy(sp StatusPolicy) {
+	w.statusPolicy = sp
+}
+
+// Signs requests with the secrets; requests that have no secret, or all
+// requests if this is never called, go unsigned.
+func (w *Worker) SetSigningSecrets(secrets *SigningSecrets) {
+	w.signingSecrets = secrets
+}
+
+// Only sends tasks to endpoints the policy allows; others are dead-lettered.
+// Addresses are checked as they're connected to, after hosts have been
+// resolved.
+func (w *Worker) SetEndpointPolicy(policy *EndpointPolicy) {
+	w.endpointPolicy = policy
+	w.transport = policy.Transport()
+}
+
+// Must be called before Connect.
+// Cancellations are also ignored if the broker can't store them, as
+// brokers older than RabbitMQ 3.9 can't.
+func (w *Worker) SetCancellationsEnabled(enabled bool) {
+	if !enabled {
+		w.cancellations = nil
+	}
+}
+
+// Endpoint hosts, as host[:port], that get their own label in delivery
+// metrics; every other host is labelled other.
+func (w *Worker) SetMetricsHosts(hosts []string) {
+	w.metricsHosts = make(map[string]bool, len(hosts))
+	for _, host := range hosts {
+		w.metricsHosts[strings.ToLower(host)] = true
+	}
+}
+
+// Must be called before Connect.
+func (w *Worker) SetAmqpTLSConfig(config *tls.Config) {
+	w.rmq.TLSConfig = config
+}
+
+func (w *Worker) Connect(connectionString string) error {
+	if err := w.rmq.ConnectRMQ(connectionString); err != nil {
+		return err
 	}
 
-	wg := sync.WaitGroup{}
-	for i := 0; i < consumers; i++ {
-		channel, err := rmq.LockChannel()
+	if w.cancellations != nil {
+		if err := w.cancellations.Prepare(); err != nil {
+			log.Warnf("Task cancellations are ignored; failed to declare stream %s: %s", CancellationStreamName, err)
+			w.cancellations = nil
+		}
+	}
+
+	for _, qc := range w.queues {
+		if _, err := w.rmq.PrepareQueue(qc.Name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Starts every queue's consumers, and blocks until they have all stopped, or
+// until Shutdown returns.
+func (w *Worker) Run() {
+	go w.cancellations.Follow()
+	w.listen()
+
+	for _, qc := range w.queues {
+		queue, err := w.rmq.PrepareQueue(qc.Name)
 		if err != nil {
 			log.Fatal(err)
 		}
 
-		msgs, err := channel.Consume(
-			queue.Name,
-			"",
-			false,
-			false,
-			false,
-			false,
-			nil,
-		)
+		for i := 0; i < qc.Consumers; i++ {
+			w.consumers.Add(1)
+			go func(prefetch int) {
+				defer w.consumers.Done()
+				w.consumeUntilStopped(queue, prefetch)
+			}(qc.Prefetch)
+		}
+
+		log.Infof("Running %d consumers with prefetch %d for queue %s", qc.Consumers, qc.Prefetch, qc.Name)
+	}
+
+	log.Infof("Waiting for messages from %d queues. To exit press CTRL+C", len(w.queues))
+	select {
+	case <-w.drained():
+	case <-w.shutdown:
+	}
+}
+
+// Closes once every consumer has stopped.
+func (w *Worker) drained() <-chan struct{} {
+	drained := make(chan struct{})
+	go func() {
+		w.consumers.Wait()
+		close(drained)
+	}()
+
+	return drained
+}
+
+// Cancels every consumer, waits for the deliveries they are already
+// processing to finish, and then closes the connection.
+// If the context expires before the in-flight deliveries finish, their
+// requests are abandoned and the connection is closed anyway, and the broker
+// will redeliver them.
+func (w *Worker) Shutdown(ctx context.Context) error {
+	defer close(w.shutdown)
+
+	w.consumerLock.Lock()
+	w.stopping = true
+	for tag, channel := range w.consumerChannels {
+		if err := channel.Cancel(tag, false); err != nil {
+			log.Warnf("Failed to cancel consumer %s: %s", tag, err)
+		}
+	}
+	w.consumerLock.Unlock()
+
+	var err error
+	select {
+	case <-w.drained():
+		log.Info("All consumers stopped")
+	case <-ctx.Done():
+		w.cancel()
+		err = fmt.Errorf("consumers did not stop before shutdown deadline: %w", ctx.Err())
+	}
+
+	if closeErr := w.rmq.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+
+	if listenErr := w.stopListening(ctx); listenErr != nil && err == nil {
+		err = listenErr
+	}
+
+	return err
+}
+
+func (w *Worker) isStopping() bool {
+	w.consumerLock.Lock()
+	defer w.consumerLock.Unlock()
+	return w.stopping
+}
+
+func ConsumeQueue(connectionString, queueName string, consumers int) {
+	ConsumeQueueWithPrefetch(connectionString, queueName, consumers, 0)
+}
+
+// Same as ConsumeQueue, but limits each consumer to holding prefetch
+// unacknowledged deliveries at a time.
+func ConsumeQueueWithPrefetch(connectionString, queueName string, consumers, prefetch int) {
+	worker := NewWorker([]QueueConfig{{Name: queueName, Consumers: consumers, Prefetch: prefetch}})
+	if err := worker.Connect(connectionString); err != nil {
+		log.Fatal(err)
+	}
+
+	worker.Run()
+}
+
+// Runs a single consumer on the queue.
+// When the consumer's channel is closed out from under it, as happens when
+// the broker restarts, a new channel is locked and the consumer is
+// registered again; this only returns once the worker is shutting down.
+func (w *Worker) consumeUntilStopped(queue *amqp.Queue, prefetch int) {
+	attempt := 0
+	for !w.isStopping() && !w.rmq.IsClosed() {
+		tag, channel, msgs, err := w.startConsumer(queue, prefetch)
 		if err != nil {
-			log.Fatal(err)
+			if w.isStopping() {
+				break
+			}
+
+			log.Warnf("Failed to start consumer for queue %s: %s", queue.Name, err)
+			time.Sleep(ReconnectDelay(attempt))
+			attempt++
+			continue
 		}
 
+		attempt = 0
 		log.Infof("Starting consumer for queue %s", queue.Name)
 
-		wg.Add(1)
-		go func() {
-			for delivery := range msgs {
-				ConsumeOne(rmq, delivery, queue)
+		for delivery := range msgs {
+			// Deliveries that were prefetched before the consumer was
+			//   cancelled go back to the queue for another worker.
+			if w.isStopping() {
+				delivery.Nack(false, true)
+				continue
 			}
 
+			w.ConsumeOne(delivery, queue)
+		}
+
+		w.consumerLock.Lock()
+		delete(w.consumerChannels, tag)
+		w.consumerLock.Unlock()
+
+		if w.isStopping() {
+			log.Infof("Consumer %s cancelled.", tag)
+		} else {
 			log.Errorf("Channel loop closed.")
-			wg.Done()
-		}()
+		}
+
+		w.rmq.DiscardChannel(channel)
+	}
+}
+
+// Prefetch limits how many unacknowledged deliveries the broker will push to
+// the consumer; 0 leaves it unlimited.
+func (w *Worker) startConsumer(queue *amqp.Queue, prefetch int) (string, *amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := w.rmq.LockChannel()
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	if prefetch > 0 {
+		if err := channel.Qos(prefetch, 0, false); err != nil {
+			w.rmq.DiscardChannel(channel)
+			return "", nil, nil, err
+		}
+	}
+
+	// Registering under the lock means Shutdown either sees this consumer
+	//   and cancels it, or this sees that the worker is stopping.
+	w.consumerLock.Lock()
+	defer w.consumerLock.Unlock()
+	if w.stopping {
+		w.rmq.DiscardChannel(channel)
+		return "", nil, nil, fmt.Errorf("worker is shutting down")
+	}
+
+	w.consumerCount++
+	tag := fmt.Sprintf("rmqhttp-%s-%d", queue.Name, w.consumerCount)
+	msgs, err := channel.Consume(
+		queue.Name,
+		tag,
+		false,
+		false,
+		false,
+		false,
+		nil,
+	)
+	if err != nil {
+		w.rmq.DiscardChannel(channel)
+		return "", nil, nil, err
 	}
 
-	log.Infof("Waiting for messages from queue. To exit press CTRL+C")
-	wg.Wait()
+	w.consumerChannels[tag] = channel
+	return tag, channel, msgs, nil
 }
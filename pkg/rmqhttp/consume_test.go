@@ -0,0 +1,129 @@
+package rmqhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerShutdown(t *testing.T) {
+	var tests = []struct {
+		name     string
+		inFlight int
+		drained  bool
+	}{
+		{"Nothing In Flight", 0, true},
+		{"Consumer Still Running", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := NewWorker([]QueueConfig{{Name: "q", Consumers: 1}})
+			w.consumers.Add(tt.inFlight)
+			defer w.consumers.Add(-tt.inFlight)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+
+			err := w.Shutdown(ctx)
+			if tt.drained {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, context.DeadlineExceeded)
+			}
+
+			// The connection is closed even when consumers didn't stop in
+			//   time, so the broker redelivers what they held.
+			assert.True(t, w.isStopping())
+			assert.True(t, w.rmq.IsClosed())
+		})
+	}
+}
+
+// Records how deliveries were settled.
+type fakeAcknowledger struct {
+	lock    sync.Mutex
+	acked   bool
+	requeue *bool
+}
+
+func (fa *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	fa.acked = true
+	return nil
+}
+
+func (fa *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	fa.lock.Lock()
+	defer fa.lock.Unlock()
+	fa.requeue = &requeue
+	return nil
+}
+
+func (fa *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return fa.Nack(tag, false, requeue)
+}
+
+func TestWorkerShutdownAbandonsRequests(t *testing.T) {
+	received := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	w := NewWorker(nil)
+	w.SetCancellationsEnabled(false)
+
+	acknowledger := &fakeAcknowledger{}
+	delivery := amqp.Delivery{
+		Acknowledger: acknowledger,
+		Body:         []byte(fmt.Sprintf(`{"Endpoint": %q, "Timeout": 3600}`, server.URL)),
+	}
+
+	w.consumers.Add(1)
+	go func() {
+		defer w.consumers.Done()
+		w.ConsumeOne(delivery, &amqp.Queue{Name: "q"})
+	}()
+	<-received
+
+	ran := make(chan struct{})
+	go func() {
+		w.Run()
+		close(ran)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, w.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+
+	select {
+	case <-w.drained():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Request was not abandoned")
+	}
+
+	acknowledger.lock.Lock()
+	defer acknowledger.lock.Unlock()
+	assert.False(t, acknowledger.acked)
+	if assert.NotNil(t, acknowledger.requeue) {
+		assert.True(t, *acknowledger.requeue)
+	}
+}
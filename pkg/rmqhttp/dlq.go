@@ -0,0 +1,439 @@
+package rmqhttp
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Every message before the page has to be fetched to read a page, so keep
+// them from getting out of hand.
+const MaxDeadLetterPageSize = 1000
+
+// One entry of the x-death header RMQ adds each time a message is
+// dead-lettered.
+type DeathInfo struct {
+	Queue       string
+	Reason      string
+	Count       int
+	Exchange    string
+	RoutingKeys []string
+	Time        time.Time
+}
+
+// A message sitting in a dead letter queue.
+// Payload is nil if the message couldn't be decoded, in which case
+// DecodeError says why, and Body holds what was there instead.
+// Reason and DeadLetteredAt come from the bridge's own headers when it
+// dead-lettered the task itself, and from x-death otherwise.
+type DeadLetter struct {
+	TaskId           string
+	Payload          *rmqPayload `json:",omitempty"`
+	DecodeError      string      `json:",omitempty"`
+	Body             string      `json:",omitempty"`
+	Attempts         int
+	RemainingRetries int
+	Reason           string
+	DeadLetteredAt   time.Time
+	LastStatus       int
+	LastError        string
+	LastResponse     string
+	History          []AttemptRecord
+	Deaths           []DeathInfo
+}
+
+type DeadLetterPage struct {
+	Queue  string
+	Total  int
+	Offset int
+	Items  []DeadLetter
+}
+
+// Drops the dead letters for endpoints the credential may not use, along
+// with those that couldn't be decoded, since their endpoint is unknown.
+// Total still counts every dead letter in the queue, so that the page's
+// position in it stays meaningful.
+func (dlp *DeadLetterPage) RemoveDisallowed(credential *Credential) {
+	items := []DeadLetter{}
+	for _, item := range dlp.Items {
+		if item.Payload != nil && credential.AllowsEndpoint(item.Payload.Endpoint) {
+			items = append(items, item)
+		}
+	}
+
+	dlp.Items = items
+}
+
+func NewDeadLetter(delivery amqp.Delivery) DeadLetter {
+	dl := DeadLetter{
+		TaskId: delivery.MessageId,
+		Deaths: []DeathInfo{},
+	}
+
+	payload, err := NewRMQPayload(delivery.Body)
+	if err != nil {
+		dl.DecodeError = err.Error()
+		dl.Body = string(delivery.Body)
+	} else {
+		dl.Payload = payload
+	}
+
+	if attempts, err := ToInt(delivery.Headers[attemptsHeaderName]); err == nil {
+		dl.Attempts = attempts
+	}
+
+	if retries, err := ToInt(delivery.Headers[retriesHeaderName]); err == nil {
+		dl.RemainingRetries = retries
+	}
+
+	deaths, _ := delivery.Headers["x-death"].([]interface{})
+	for _, death := range deaths {
+		table, ok := death.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		di := DeathInfo{}
+		di.Queue, _ = table["queue"].(string)
+		di.Reason, _ = table["reason"].(string)
+		di.Exchange, _ = table["exchange"].(string)
+		di.Time, _ = table["time"].(time.Time)
+		di.Count, _ = ToInt(table["count"])
+
+		routingKeys, _ := table["routing-keys"].([]interface{})
+		for _, routingKey := range routingKeys {
+			if rk, ok := routingKey.(string); ok {
+				di.RoutingKeys = append(di.RoutingKeys, rk)
+			}
+		}
+
+		dl.Deaths = append(dl.Deaths, di)
+	}
+
+	dl.LastStatus, _ = ToInt(delivery.Headers[lastStatusHeaderName])
+	dl.LastError, _ = delivery.Headers[lastErrorHeaderName].(string)
+	dl.LastResponse, _ = delivery.Headers[lastResponseHeaderName].(string)
+	dl.History = attemptHistory(delivery.Headers)
+
+	dl.Reason, _ = delivery.Headers[deadLetterReasonHeaderName].(string)
+	dl.DeadLetteredAt, _ = delivery.Headers[deadLetteredAtHeaderName].(time.Time)
+
+	// RMQ puts the most recent death first.
+	if len(dl.Deaths) != 0 {
+		if dl.Reason == "" {
+			dl.Reason = dl.Deaths[0].Reason
+		}
+
+		if dl.DeadLetteredAt.IsZero() {
+			dl.DeadLetteredAt = dl.Deaths[0].Time
+		}
+	}
+
+	return dl
+}
+
+// Limits on a queue's dead letters, past which something needs looking at.
+// Depth alerts once there are more than MaxDepth dead letters, and age once
+// the oldest of them has been dead-lettered for longer than MaxAge; a MaxAge
+// of 0 doesn't check age at all.
+type DeadLetterThresholds struct {
+	MaxDepth int
+	MaxAge   time.Duration
+}
+
+type DeadLetterAlert struct {
+	Queue                string
+	Depth                int
+	OldestDeadLetteredAt *time.Time
+	Thresholds           DeadLetterThresholds
+	Reasons              []string
+}
+
+func (a *DeadLetterAlert) Alerting() bool {
+	return len(a.Reasons) != 0
+}
+
+// Returns why the thresholds are exceeded, if they are.
+// The oldest dead letter's time is ignored when it's unknown.
+func (t DeadLetterThresholds) Check(depth int, oldest, now time.Time) []string {
+	reasons := []string{}
+	if depth > t.MaxDepth {
+		reasons = append(reasons, fmt.Sprintf("DLQ has %d items, more than %d", depth, t.MaxDepth))
+	}
+
+	if t.MaxAge != 0 && !oldest.IsZero() {
+		if age := now.Sub(oldest); age > t.MaxAge {
+			reasons = append(reasons, fmt.Sprintf("Oldest dead letter is %s old, more than %s", age.Truncate(time.Second), t.MaxAge))
+		}
+	}
+
+	return reasons
+}
+
+// Only peeks at the oldest dead letter when there's an age to check.
+func (rmq *RMQ) CheckDeadLetters(queueName string, thresholds DeadLetterThresholds) (*DeadLetterAlert, error) {
+	limit := 0
+	if thresholds.MaxAge != 0 {
+		limit = 1
+	}
+
+	page, err := rmq.ListDeadLetters(queueName, 0, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	alert := DeadLetterAlert{
+		Queue:      page.Queue,
+		Depth:      page.Total,
+		Thresholds: thresholds,
+	}
+
+	var oldest time.Time
+	if len(page.Items) != 0 && !page.Items[0].DeadLetteredAt.IsZero() {
+		oldest = page.Items[0].DeadLetteredAt
+		alert.OldestDeadLetteredAt = &oldest
+	}
+
+	alert.Reasons = thresholds.Check(alert.Depth, oldest, time.Now())
+	return &alert, nil
+}
+
+// Reads a page of the queue's dead letters without removing them.
+// Messages are fetched with basic.get, and all of them are requeued once the
+// page has been read, so they keep their place in the queue.
+// Messages being read by a concurrent call won't show up in this one.
+func (rmq *RMQ) ListDeadLetters(queueName string, offset, limit int) (*DeadLetterPage, error) {
+	dlqName := DeadLetterQueueName(queueName)
+
+	channel, err := rmq.LockChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	// Anything fetched but not acked goes back to the queue when the channel
+	//   closes, so it's never returned to the pool.
+	defer rmq.DiscardChannel(channel)
+
+	queue, err := channel.QueueInspect(dlqName)
+	if err != nil {
+		return nil, err
+	}
+
+	page := DeadLetterPage{
+		Queue:  dlqName,
+		Total:  queue.Messages,
+		Offset: offset,
+		Items:  []DeadLetter{},
+	}
+
+	var lastTag uint64
+	for i := 0; i < offset+limit; i++ {
+		delivery, ok, err := channel.Get(dlqName, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			break
+		}
+
+		lastTag = delivery.DeliveryTag
+		if i >= offset {
+			page.Items = append(page.Items, NewDeadLetter(delivery))
+		}
+	}
+
+	if lastTag != 0 {
+		if err := channel.Nack(lastTag, true, true); err != nil {
+			return nil, err
+		}
+	}
+
+	return &page, nil
+}
+
+// Picks which dead letters replay and purge act on.
+// Zero values don't filter anything.
+//
+// EndpointHost: Only tasks whose endpoint is on this host.
+// OlderThan:    Only tasks that were dead-lettered at least this long ago.
+// NewerThan:    Only tasks that were dead-lettered at most this long ago.
+// Limit:        Act on at most this many tasks.
+type DeadLetterFilter struct {
+	EndpointHost string
+	OlderThan    time.Duration
+	NewerThan    time.Duration
+	Limit        int
+}
+
+func (f DeadLetterFilter) Matches(dl DeadLetter, now time.Time) bool {
+	if f.EndpointHost != "" {
+		if dl.Payload == nil {
+			return false
+		}
+
+		u, err := url.Parse(dl.Payload.Endpoint)
+		if err != nil || !strings.EqualFold(u.Hostname(), f.EndpointHost) {
+			return false
+		}
+	}
+
+	if f.OlderThan != 0 || f.NewerThan != 0 {
+		if dl.DeadLetteredAt.IsZero() {
+			return false
+		}
+
+		age := now.Sub(dl.DeadLetteredAt)
+		if f.OlderThan != 0 && age < f.OlderThan {
+			return false
+		}
+
+		if f.NewerThan != 0 && age > f.NewerThan {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lists the tasks that were handled.
+// When handling stops partway through, the tasks before that are still
+// listed, and Error says what went wrong.
+type DeadLetterResult struct {
+	Queue   string
+	DryRun  bool
+	TaskIds []string
+	Error   string `json:",omitempty"`
+}
+
+// Moves matching dead letters back onto their queue, with their retries and
+// attempts reset to what the task was first sent with.
+// Tasks that can't be decoded would only fail again, so they're left alone.
+func (rmq *RMQ) ReplayDeadLetters(queueName string, filter DeadLetterFilter, dryRun bool) (*DeadLetterResult, error) {
+	return rmq.processDeadLetters(queueName, filter, dryRun, func(delivery amqp.Delivery, dl DeadLetter) (bool, error) {
+		if dl.Payload == nil {
+			return false, nil
+		}
+
+		if dryRun {
+			return true, nil
+		}
+
+		err := rmq.Publish(
+			"",
+			queueName,
+			amqp.Publishing{
+				MessageId:    delivery.MessageId,
+				ContentType:  delivery.ContentType,
+				DeliveryMode: delivery.DeliveryMode,
+				Body:         delivery.Body,
+				Headers:      replayHeaders(delivery.Headers, dl.Payload),
+			},
+		)
+		return err == nil, err
+	})
+}
+
+// Drops matching dead letters for good.
+func (rmq *RMQ) PurgeDeadLetters(queueName string, filter DeadLetterFilter, dryRun bool) (*DeadLetterResult, error) {
+	return rmq.processDeadLetters(queueName, filter, dryRun, func(delivery amqp.Delivery, dl DeadLetter) (bool, error) {
+		return true, nil
+	})
+}
+
+// Fetches every message that was in the DLQ when this started, and hands the
+// ones that match the filter to process.
+// Messages that process reports handling are acked, unless this is a dry
+// run; everything else is requeued once the whole queue has been seen.
+func (rmq *RMQ) processDeadLetters(queueName string, filter DeadLetterFilter, dryRun bool, process func(amqp.Delivery, DeadLetter) (bool, error)) (*DeadLetterResult, error) {
+	dlqName := DeadLetterQueueName(queueName)
+
+	channel, err := rmq.LockChannel()
+	if err != nil {
+		return nil, err
+	}
+
+	// Holding on to unmatched messages until the channel closes keeps them
+	//   from being fetched again, and puts them back when it does.
+	defer rmq.DiscardChannel(channel)
+
+	queue, err := channel.QueueInspect(dlqName)
+	if err != nil {
+		return nil, err
+	}
+
+	result := DeadLetterResult{
+		Queue:   dlqName,
+		DryRun:  dryRun,
+		TaskIds: []string{},
+	}
+
+	now := time.Now()
+	for i := 0; i < queue.Messages; i++ {
+		if filter.Limit != 0 && len(result.TaskIds) >= filter.Limit {
+			break
+		}
+
+		delivery, ok, err := channel.Get(dlqName, false)
+		if err != nil {
+			return &result, err
+		}
+
+		if !ok {
+			break
+		}
+
+		dl := NewDeadLetter(delivery)
+		if !filter.Matches(dl, now) {
+			continue
+		}
+
+		handled, err := process(delivery, dl)
+		if err != nil {
+			return &result, err
+		}
+
+		if !handled {
+			continue
+		}
+
+		if !dryRun {
+			if err := delivery.Ack(false); err != nil {
+				return &result, err
+			}
+		}
+
+		result.TaskIds = append(result.TaskIds, dl.TaskId)
+	}
+
+	return &result, nil
+}
+
+// Headers for a replayed task; the dead-lettering history is dropped, and the
+// retry headers start over from the task's own settings.
+// The record of past failures is kept, in case it fails again.
+func replayHeaders(headers amqp.Table, payload *rmqPayload) amqp.Table {
+	replayed := amqp.Table{}
+	for key, value := range headers {
+		if key == "x-death" || strings.HasPrefix(key, "x-first-death-") || strings.HasPrefix(key, "x-last-death-") {
+			continue
+		}
+
+		if key == deadLetterReasonHeaderName || key == deadLetteredAtHeaderName {
+			continue
+		}
+
+		replayed[key] = value
+	}
+
+	replayed[retriesHeaderName] = payload.Retries
+	replayed[retryDelayHeaderName] = payload.Backoff
+	replayed[attemptsHeaderName] = 0
+
+	return replayed
+}
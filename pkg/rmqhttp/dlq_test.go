@@ -0,0 +1,164 @@
+package rmqhttp
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewDeadLetter(t *testing.T) {
+	diedAt := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	delivery := amqp.Delivery{
+		MessageId: "task-1",
+		Body:      []byte(`{"Endpoint": "http://example.com"}`),
+		Headers: amqp.Table{
+			attemptsHeaderName: int32(2),
+			retriesHeaderName:  int32(0),
+			"x-death": []interface{}{
+				amqp.Table{
+					"queue":        "q",
+					"reason":       "rejected",
+					"count":        int64(1),
+					"exchange":     "",
+					"routing-keys": []interface{}{"q"},
+					"time":         diedAt,
+				},
+			},
+		},
+	}
+
+	dl := NewDeadLetter(delivery)
+	assert.Equal(t, "task-1", dl.TaskId)
+	assert.Equal(t, "http://example.com", dl.Payload.Endpoint)
+	assert.Equal(t, 2, dl.Attempts)
+	assert.Equal(t, 0, dl.RemainingRetries)
+	assert.Equal(t, []DeathInfo{{"q", "rejected", 1, "", []string{"q"}, diedAt}}, dl.Deaths)
+	assert.Equal(t, "rejected", dl.Reason)
+	assert.Equal(t, diedAt, dl.DeadLetteredAt)
+}
+
+func TestNewDeadLetterFailureHeaders(t *testing.T) {
+	diedAt := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	headers := amqp.Table{attemptsHeaderName: 1}
+	recordFailure(headers, 0, NewDeliveryFailure(0, "connection refused", nil), diedAt.Add(-time.Minute))
+	recordFailure(headers, 1, NewDeliveryFailure(500, "HTTP 500", []byte("oops")), diedAt)
+	headers[deadLetterReasonHeaderName] = "retries exhausted"
+	headers[deadLetteredAtHeaderName] = diedAt
+
+	dl := NewDeadLetter(amqp.Delivery{Body: []byte(`{"Endpoint": "http://example.com"}`), Headers: headers})
+	assert.Equal(t, "retries exhausted", dl.Reason)
+	assert.Equal(t, diedAt, dl.DeadLetteredAt)
+	assert.Equal(t, 500, dl.LastStatus)
+	assert.Equal(t, "HTTP 500", dl.LastError)
+	assert.Equal(t, "oops", dl.LastResponse)
+	assert.Equal(t, []AttemptRecord{
+		{0, diedAt.Add(-time.Minute), 0, "connection refused"},
+		{1, diedAt, 500, "HTTP 500"},
+	}, dl.History)
+}
+
+func TestNewDeadLetterUndecodable(t *testing.T) {
+	dl := NewDeadLetter(amqp.Delivery{Body: []byte("not json")})
+	assert.Nil(t, dl.Payload)
+	assert.Equal(t, "invalid JSON", dl.DecodeError)
+	assert.Equal(t, "not json", dl.Body)
+}
+
+func TestDeadLetterFilterMatches(t *testing.T) {
+	now := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	dl := DeadLetter{
+		Payload:        &rmqPayload{Endpoint: "http://Example.com:8080/hook"},
+		DeadLetteredAt: now.Add(-2 * time.Hour),
+	}
+
+	var tests = []struct {
+		name    string
+		filter  DeadLetterFilter
+		matches bool
+	}{
+		{"No Filter", DeadLetterFilter{}, true},
+		{"Host", DeadLetterFilter{EndpointHost: "example.com"}, true},
+		{"Other Host", DeadLetterFilter{EndpointHost: "example.org"}, false},
+		{"Older Than", DeadLetterFilter{OlderThan: time.Hour}, true},
+		{"Not Older Than", DeadLetterFilter{OlderThan: 3 * time.Hour}, false},
+		{"Newer Than", DeadLetterFilter{NewerThan: 3 * time.Hour}, true},
+		{"Not Newer Than", DeadLetterFilter{NewerThan: time.Hour}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.matches, tt.filter.Matches(dl, now))
+		})
+	}
+}
+
+func TestDeadLetterThresholdsCheck(t *testing.T) {
+	now := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name       string
+		thresholds DeadLetterThresholds
+		depth      int
+		oldest     time.Time
+		reasons    int
+	}{
+		{"Empty", DeadLetterThresholds{}, 0, time.Time{}, 0},
+		{"Any Depth", DeadLetterThresholds{}, 1, now, 1},
+		{"Within Depth", DeadLetterThresholds{MaxDepth: 5}, 5, now, 0},
+		{"Past Depth", DeadLetterThresholds{MaxDepth: 5}, 6, now, 1},
+		{"Age Unchecked", DeadLetterThresholds{MaxDepth: 5}, 1, now.Add(-time.Hour), 0},
+		{"Within Age", DeadLetterThresholds{MaxDepth: 5, MaxAge: time.Hour}, 1, now.Add(-time.Minute), 0},
+		{"Past Age", DeadLetterThresholds{MaxDepth: 5, MaxAge: time.Hour}, 1, now.Add(-2 * time.Hour), 1},
+		{"Unknown Age", DeadLetterThresholds{MaxDepth: 5, MaxAge: time.Hour}, 1, time.Time{}, 0},
+		{"Both", DeadLetterThresholds{MaxAge: time.Hour}, 1, now.Add(-2 * time.Hour), 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Len(t, tt.thresholds.Check(tt.depth, tt.oldest, now), tt.reasons)
+		})
+	}
+}
+
+func TestReplayHeaders(t *testing.T) {
+	headers := amqp.Table{
+		retriesHeaderName:            0,
+		attemptsHeaderName:           3,
+		retryDelayHeaderName:         1,
+		idempotencyKeyAmqpHeaderName: "key",
+		"x-death":                    []interface{}{},
+		"x-first-death-reason":       "rejected",
+		deadLetterReasonHeaderName:   "retries exhausted",
+		lastStatusHeaderName:         500,
+	}
+
+	replayed := replayHeaders(headers, &rmqPayload{Retries: 2, Backoff: 5})
+	assert.Equal(t, amqp.Table{
+		retriesHeaderName:            2,
+		attemptsHeaderName:           0,
+		retryDelayHeaderName:         5,
+		idempotencyKeyAmqpHeaderName: "key",
+		lastStatusHeaderName:         500,
+	}, replayed)
+}
+
+func TestDeadLetterPageRemoveDisallowed(t *testing.T) {
+	page := DeadLetterPage{Queue: "q-dead-letter-queue", Total: 3}
+	for _, body := range []string{
+		`{"Endpoint": "https://api.example.com/hook"}`,
+		`{"Endpoint": "https://other.example.org/hook", "Headers": {"Authorization": "secret"}}`,
+		`{`,
+	} {
+		page.Items = append(page.Items, NewDeadLetter(amqp.Delivery{Body: []byte(body)}))
+	}
+
+	page.RemoveDisallowed(&Credential{Name: "c", Queues: []string{"q"}, Hosts: []string{"*.example.com"}})
+	assert.Equal(t, 3, page.Total)
+	if assert.Len(t, page.Items, 1) {
+		assert.Equal(t, "https://api.example.com/hook", page.Items[0].Payload.Endpoint)
+	}
+}
@@ -0,0 +1,261 @@
+package rmqhttp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrEndpointNotAllowed = errors.New("endpoint not allowed")
+
+// Shared address space for carrier-grade NAT, which net.IP.IsPrivate doesn't
+// cover.
+var sharedAddressSpace = mustParseCIDR("100.64.0.0/10")
+
+// Describes which endpoints tasks may be sent to.
+//
+// Schemes:         URL schemes allowed; empty allows http and https.
+// AllowedHosts:    Patterns, as understood by path.Match, of the hosts
+// allowed; empty allows every host.
+// DeniedHosts:     Patterns of hosts that are never allowed.
+// AllowedNetworks: CIDRs endpoints must resolve into, if any are given.
+// Addresses in them are allowed even when BlockPrivate would block them.
+// DeniedNetworks:  CIDRs endpoints must never resolve into.
+// BlockPrivate:    Blocks loopback, private, link-local, and other addresses
+// that aren't publicly routable, and hosts that can't be resolved; off unless
+// set, so every address is allowed by default.
+type EndpointPolicyConfig struct {
+	Schemes         []string
+	AllowedHosts    []string
+	DeniedHosts     []string
+	AllowedNetworks []string
+	DeniedNetworks  []string
+	BlockPrivate    bool
+}
+
+// A nil policy allows every endpoint.
+type EndpointPolicy struct {
+	schemes         []string
+	allowedHosts    []string
+	deniedHosts     []string
+	allowedNetworks []*net.IPNet
+	deniedNetworks  []*net.IPNet
+	blockPrivate    bool
+}
+
+func NewEndpointPolicy(config EndpointPolicyConfig) (*EndpointPolicy, error) {
+	p := EndpointPolicy{
+		schemes:      []string{"http", "https"},
+		allowedHosts: config.AllowedHosts,
+		deniedHosts:  config.DeniedHosts,
+		blockPrivate: config.BlockPrivate,
+	}
+
+	if len(config.Schemes) != 0 {
+		p.schemes = []string{}
+		for _, scheme := range config.Schemes {
+			p.schemes = append(p.schemes, strings.ToLower(scheme))
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, config.AllowedHosts...), config.DeniedHosts...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid host pattern %q: %w", pattern, err)
+		}
+	}
+
+	for _, networks := range []struct {
+		cidrs []string
+		nets  *[]*net.IPNet
+	}{
+		{config.AllowedNetworks, &p.allowedNetworks},
+		{config.DeniedNetworks, &p.deniedNetworks},
+	} {
+		for _, cidr := range networks.cidrs {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q: %w", cidr, err)
+			}
+
+			*networks.nets = append(*networks.nets, network)
+		}
+	}
+
+	return &p, nil
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
+
+func (p *EndpointPolicy) checksAddresses() bool {
+	return len(p.allowedNetworks) != 0 || len(p.deniedNetworks) != 0 || p.blockPrivate
+}
+
+// Checks the endpoint's scheme and host, and, when it's an address, the
+// address.
+// Host names aren't resolved; see CheckEndpoint.
+func (p *EndpointPolicy) CheckURL(endpoint string) error {
+	if p == nil {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrEndpointNotAllowed, err)
+	}
+
+	scheme := strings.ToLower(u.Scheme)
+	if !matchesAny(p.schemes, scheme) {
+		return fmt.Errorf("%w: scheme %q", ErrEndpointNotAllowed, u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return fmt.Errorf("%w: no host", ErrEndpointNotAllowed)
+	}
+
+	if matchesAny(p.deniedHosts, host) {
+		return fmt.Errorf("%w: host %s is denied", ErrEndpointNotAllowed, host)
+	}
+
+	if len(p.allowedHosts) != 0 && !matchesAny(p.allowedHosts, host) {
+		return fmt.Errorf("%w: host %s is not allowed", ErrEndpointNotAllowed, host)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return p.CheckIP(ip)
+	}
+
+	return nil
+}
+
+// Same as CheckURL, but also resolves the endpoint's host, and checks every
+// address it resolves to.
+// Hosts that fail to resolve are refused when private addresses are blocked,
+// since they can't be shown not to be private; otherwise they're allowed, and
+// the worker checks addresses again when it connects.
+func (p *EndpointPolicy) CheckEndpoint(endpoint string) error {
+	if err := p.CheckURL(endpoint); err != nil || p == nil || !p.checksAddresses() {
+		return err
+	}
+
+	u, _ := url.Parse(endpoint)
+	if net.ParseIP(u.Hostname()) != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		if p.blockPrivate {
+			return fmt.Errorf("%w: host %s could not be resolved: %s", ErrEndpointNotAllowed, u.Hostname(), err)
+		}
+
+		return nil
+	}
+
+	for _, address := range addresses {
+		if err := p.CheckIP(address.IP); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *EndpointPolicy) CheckIP(ip net.IP) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, network := range p.deniedNetworks {
+		if network.Contains(ip) {
+			return fmt.Errorf("%w: address %s is in denied network %s", ErrEndpointNotAllowed, ip, network)
+		}
+	}
+
+	for _, network := range p.allowedNetworks {
+		if network.Contains(ip) {
+			return nil
+		}
+	}
+
+	if len(p.allowedNetworks) != 0 {
+		return fmt.Errorf("%w: address %s is not in an allowed network", ErrEndpointNotAllowed, ip)
+	}
+
+	if p.blockPrivate && isPrivateAddress(ip) {
+		return fmt.Errorf("%w: address %s is private", ErrEndpointNotAllowed, ip)
+	}
+
+	return nil
+}
+
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// Builds a transport that checks every address it connects to against the
+// policy, after the host has been resolved, so names that resolve to blocked
+// addresses can't get around it.
+// Proxies from the environment aren't used, since the policy would only see
+// the proxy's address.
+func (p *EndpointPolicy) Transport() http.RoundTripper {
+	if p == nil || !p.checksAddresses() {
+		return http.DefaultTransport
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("%w: unresolved address %s", ErrEndpointNotAllowed, address)
+			}
+
+			return p.CheckIP(ip)
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return transport
+}
+
+// Checks redirects the same way as the original endpoint, so they can't be
+// used to reach endpoints that couldn't be asked for directly.
+func (p *EndpointPolicy) CheckRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	return p.CheckURL(req.URL.String())
+}
@@ -0,0 +1,138 @@
+package rmqhttp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointPolicyCheckURL(t *testing.T) {
+	policy, err := NewEndpointPolicy(EndpointPolicyConfig{
+		AllowedHosts:   []string{"*.example.com", "10.1.2.3", "127.0.0.1"},
+		DeniedHosts:    []string{"admin.example.com"},
+		DeniedNetworks: []string{"10.0.0.0/8"},
+		BlockPrivate:   true,
+	})
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		name     string
+		endpoint string
+		allowed  bool
+	}{
+		{"Allowed Host", "https://api.example.com/hook", true},
+		{"Allowed Host Case", "https://API.Example.com:8443/hook", true},
+		{"Scheme", "ftp://api.example.com/hook", false},
+		{"Denied Host", "https://admin.example.com/hook", false},
+		{"Other Host", "https://example.org/hook", false},
+		{"Denied Network", "http://10.1.2.3/hook", false},
+		{"Private Address", "http://127.0.0.1/hook", false},
+		{"No Host", "http:///hook", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := policy.CheckURL(tt.endpoint)
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrEndpointNotAllowed)
+			}
+		})
+	}
+}
+
+func TestEndpointPolicyCheckIP(t *testing.T) {
+	var tests = []struct {
+		name    string
+		config  EndpointPolicyConfig
+		ip      string
+		allowed bool
+	}{
+		{"No Rules", EndpointPolicyConfig{}, "127.0.0.1", true},
+		{"Loopback", EndpointPolicyConfig{BlockPrivate: true}, "127.0.0.1", false},
+		{"Private", EndpointPolicyConfig{BlockPrivate: true}, "192.168.1.1", false},
+		{"Metadata", EndpointPolicyConfig{BlockPrivate: true}, "169.254.169.254", false},
+		{"Shared Address Space", EndpointPolicyConfig{BlockPrivate: true}, "100.64.0.1", false},
+		{"Unspecified", EndpointPolicyConfig{BlockPrivate: true}, "0.0.0.0", false},
+		{"IPv6 Loopback", EndpointPolicyConfig{BlockPrivate: true}, "::1", false},
+		{"IPv6 Unique Local", EndpointPolicyConfig{BlockPrivate: true}, "fd00::1", false},
+		{"Public", EndpointPolicyConfig{BlockPrivate: true}, "203.0.113.1", true},
+		{"Allowed Private", EndpointPolicyConfig{BlockPrivate: true, AllowedNetworks: []string{"10.0.0.0/8"}}, "10.0.0.1", true},
+		{"Outside Allowed", EndpointPolicyConfig{AllowedNetworks: []string{"10.0.0.0/8"}}, "203.0.113.1", false},
+		{"Denied Over Allowed", EndpointPolicyConfig{AllowedNetworks: []string{"10.0.0.0/8"}, DeniedNetworks: []string{"10.0.0.0/24"}}, "10.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := NewEndpointPolicy(tt.config)
+			assert.NoError(t, err)
+
+			err = policy.CheckIP(net.ParseIP(tt.ip))
+			if tt.allowed {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrEndpointNotAllowed)
+			}
+		})
+	}
+}
+
+func TestNewEndpointPolicyInvalid(t *testing.T) {
+	_, err := NewEndpointPolicy(EndpointPolicyConfig{AllowedNetworks: []string{"10.0.0.0"}})
+	assert.Error(t, err)
+
+	_, err = NewEndpointPolicy(EndpointPolicyConfig{DeniedHosts: []string{"["}})
+	assert.Error(t, err)
+}
+
+func TestEndpointPolicyTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	// Names that resolve to blocked addresses are caught when connecting.
+	endpoint := "http://localhost:" + server.URL[len("http://127.0.0.1:"):]
+
+	blocking, err := NewEndpointPolicy(EndpointPolicyConfig{BlockPrivate: true})
+	assert.NoError(t, err)
+	assert.NoError(t, blocking.CheckURL(endpoint))
+
+	_, err = (&http.Client{Transport: blocking.Transport()}).Get(endpoint)
+	assert.ErrorIs(t, err, ErrEndpointNotAllowed)
+
+	allowing, err := NewEndpointPolicy(EndpointPolicyConfig{BlockPrivate: true, AllowedNetworks: []string{"127.0.0.0/8", "::1/128"}})
+	assert.NoError(t, err)
+
+	resp, err := (&http.Client{Transport: allowing.Transport()}).Get(endpoint)
+	assert.NoError(t, err)
+	resp.Body.Close()
+}
+
+func TestEndpointPolicyCheckEndpointUnresolvable(t *testing.T) {
+	// The .invalid domain never resolves.
+	endpoint := "http://rmqhttp.invalid/"
+
+	blocking, err := NewEndpointPolicy(EndpointPolicyConfig{BlockPrivate: true})
+	assert.NoError(t, err)
+	assert.ErrorIs(t, blocking.CheckEndpoint(endpoint), ErrEndpointNotAllowed)
+
+	denying, err := NewEndpointPolicy(EndpointPolicyConfig{DeniedNetworks: []string{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+	assert.NoError(t, denying.CheckEndpoint(endpoint))
+}
+
+func TestNewRMQPayloadWithPolicy(t *testing.T) {
+	policy, err := NewEndpointPolicy(EndpointPolicyConfig{BlockPrivate: true})
+	assert.NoError(t, err)
+
+	_, err = NewRMQPayloadWithPolicy([]byte(`{"endpoint": "http://169.254.169.254/latest"}`), policy)
+	assert.ErrorIs(t, err, ErrEndpointNotAllowed)
+
+	_, err = NewRMQPayloadWithPolicy([]byte(`{"endpoint": "http://169.254.169.254/latest"}`), nil)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,108 @@
+package rmqhttp
+
+import (
+	"time"
+	"unicode/utf8"
+)
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Headers that record why a task failed.
+// The x-last-* headers describe the most recent attempt, and the history has
+// an entry for every failed attempt; they all travel with the task through
+// its retries, and into the DLQ.
+const lastStatusHeaderName string = "x-last-status"
+const lastErrorHeaderName string = "x-last-error"
+const lastResponseHeaderName string = "x-last-response"
+const attemptHistoryHeaderName string = "x-attempt-history"
+
+// Set when the bridge itself dead-letters a task.
+const deadLetterReasonHeaderName string = "x-dead-letter-reason"
+const deadLetteredAtHeaderName string = "x-dead-lettered-at"
+
+// Response bodies are only kept for context, so keep headers from getting
+// large.
+const maxRecordedResponseLength = 1024
+
+// Why an attempt to deliver a task failed.
+//
+// Status:   HTTP status the endpoint responded with; 0 if it never responded.
+// Error:    What went wrong.
+// Response: Start of the body the endpoint responded with.
+type DeliveryFailure struct {
+	Status   int
+	Error    string
+	Response string
+}
+
+func NewDeliveryFailure(status int, err string, response []byte) *DeliveryFailure {
+	return &DeliveryFailure{
+		Status:   status,
+		Error:    err,
+		Response: truncateResponse(response),
+	}
+}
+
+// An entry in a task's attempt history.
+type AttemptRecord struct {
+	Attempt int
+	Time    time.Time
+	Status  int
+	Error   string
+}
+
+// Cuts the response down to size without splitting a multi-byte character.
+func truncateResponse(response []byte) string {
+	if len(response) <= maxRecordedResponseLength {
+		return string(response)
+	}
+
+	end := maxRecordedResponseLength
+	for end > 0 && !utf8.RuneStart(response[end]) {
+		end--
+	}
+
+	return string(response[:end])
+}
+
+// Records the failure of the given attempt in the headers.
+func recordFailure(headers amqp.Table, attempt int, failure *DeliveryFailure, now time.Time) {
+	if failure == nil {
+		return
+	}
+
+	headers[lastStatusHeaderName] = failure.Status
+	headers[lastErrorHeaderName] = failure.Error
+	headers[lastResponseHeaderName] = failure.Response
+
+	history, _ := headers[attemptHistoryHeaderName].([]interface{})
+	headers[attemptHistoryHeaderName] = append(history, amqp.Table{
+		"attempt": attempt,
+		"time":    now,
+		"status":  failure.Status,
+		"error":   failure.Error,
+	})
+}
+
+func attemptHistory(headers amqp.Table) []AttemptRecord {
+	records := []AttemptRecord{}
+
+	history, _ := headers[attemptHistoryHeaderName].([]interface{})
+	for _, entry := range history {
+		table, ok := entry.(amqp.Table)
+		if !ok {
+			continue
+		}
+
+		record := AttemptRecord{}
+		record.Attempt, _ = ToInt(table["attempt"])
+		record.Time, _ = table["time"].(time.Time)
+		record.Status, _ = ToInt(table["status"])
+		record.Error, _ = table["error"].(string)
+		records = append(records, record)
+	}
+
+	return records
+}
@@ -1,40 +1,97 @@
 package rmqhttp
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"time"
 )
 
 import (
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Name of the route variable that selects which queue a request targets.
+// Requests on routes without it go to the queue given to Connect.
+const QueueRouteVariable = "name"
+
+// Name of the route variable holding the ID of the task to cancel.
+const TaskIdRouteVariable = "id"
+
+// Response header carrying the ID of the task that was enqueued.
+const TaskIdHeaderName = "X-Task-Id"
+
 type HttpController struct {
-	rmq   *RMQ
-	queue *amqp.Queue
+	rmq           *RMQ
+	queue         *amqp.Queue
+	cancellations *CancellationStore
+	idempotency   IdempotencyStore
+
+	// Publishes tasks, waiting for the broker's confirm; RMQ.Publish, unless
+	//   a test replaces it.
+	publish func(exchange, key string, msg amqp.Publishing) error
+
+	// Patterns, as understood by path.Match, of the queues requests may name.
+	// Empty allows every queue.
+	allowedQueues []string
 
 	managementUrl *url.URL
+
+	persistentByDefault bool
+
+	deadLetterThresholds DeadLetterThresholds
+
+	endpointPolicy *EndpointPolicy
 }
 
 func NewHttpController() *HttpController {
+	rmq := NewRMQ()
 	httpController := HttpController{
-		rmq:   NewRMQ(),
-		queue: nil,
+		rmq:                 rmq,
+		queue:               nil,
+		cancellations:       NewCancellationStore(rmq),
+		idempotency:         NewMemoryIdempotencyStore(24 * time.Hour),
+		publish:             rmq.Publish,
+		persistentByDefault: true,
 	}
 	return &httpController
 }
 
+// Connects to RMQ, and prepares the default queue.
+// The default queue may be empty, in which case only requests that name a
+// queue can be served.
 func (hc *HttpController) Connect(connectionString, queueName string) error {
 	if err := hc.rmq.ConnectRMQ(connectionString); err != nil {
 		return err
 	}
 
+	if hc.cancellations != nil {
+		if err := hc.cancellations.Prepare(); err != nil {
+			log.Warnf("Cancelling tasks is disabled; failed to declare stream %s: %s", CancellationStreamName, err)
+			hc.cancellations = nil
+		}
+	}
+
+	if store, ok := hc.idempotency.(rmqBackedStore); ok {
+		if err := store.start(hc.rmq); err != nil {
+			return err
+		}
+	}
+
+	if queueName == "" {
+		return nil
+	}
+
 	queue, err := hc.rmq.PrepareQueue(queueName)
 	if err != nil {
 		return err
@@ -45,6 +102,64 @@ func (hc *HttpController) Connect(connectionString, queueName string) error {
 	return nil
 }
 
+func (hc *HttpController) Close() error {
+	return hc.rmq.Close()
+}
+
+func (hc *HttpController) SetAllowedQueues(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid queue pattern %q: %w", pattern, err)
+		}
+	}
+
+	hc.allowedQueues = patterns
+	return nil
+}
+
+func (hc *HttpController) queueAllowed(queueName string) bool {
+	if len(hc.allowedQueues) == 0 {
+		return true
+	}
+
+	if hc.queue != nil && hc.queue.Name == queueName {
+		return true
+	}
+
+	for _, pattern := range hc.allowedQueues {
+		if matched, _ := path.Match(pattern, queueName); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Finds the name of the queue the request targets, responding with an error
+// if there isn't one that can be used.
+func (hc *HttpController) resolveQueue(w http.ResponseWriter, r *http.Request) (string, bool) {
+	queueName, ok := mux.Vars(r)[QueueRouteVariable]
+	if !ok {
+		if hc.queue == nil {
+			hc.respondError(w, http.StatusNotFound, "No default queue configured")
+			return "", false
+		}
+
+		queueName = hc.queue.Name
+	} else if !hc.queueAllowed(queueName) {
+		hc.respondError(w, http.StatusForbidden, fmt.Sprintf("Queue %s is not allowed", queueName))
+		return "", false
+	}
+
+	if credential := CredentialFromContext(r.Context()); credential != nil && !credential.AllowsQueue(queueName) {
+		msg := fmt.Sprintf("Credential %s may not use queue %s", credential.Name, queueName)
+		hc.respondError(w, http.StatusForbidden, msg)
+		return "", false
+	}
+
+	return queueName, true
+}
+
 func (hc *HttpController) SetManagementConnectionString(mcs string) {
 	u, err := url.Parse(mcs)
 	if err != nil {
@@ -54,26 +169,114 @@ func (hc *HttpController) SetManagementConnectionString(mcs string) {
 	hc.managementUrl = u
 }
 
+// Must be called before Connect.
+func (hc *HttpController) SetAmqpTLSConfig(config *tls.Config) {
+	hc.rmq.TLSConfig = config
+}
+
+// Sets how long HttpHandler waits for the broker to confirm a message before
+// giving up on it.
+func (hc *HttpController) SetPublishTimeout(timeout time.Duration) {
+	hc.rmq.PublishTimeout = timeout
+}
+
+// Must be called before Connect.
+func (hc *HttpController) SetIdempotencyStore(store IdempotencyStore) {
+	hc.idempotency = store
+}
+
+// Sets whether tasks that don't specify Persistent are written to disk by the
+// broker.
+func (hc *HttpController) SetPersistentByDefault(persistent bool) {
+	hc.persistentByDefault = persistent
+}
+
+// Must be called before Connect.
+// Cancellations are also disabled if the broker can't store them, as
+// brokers older than RabbitMQ 3.9 can't.
+func (hc *HttpController) SetCancellationsEnabled(enabled bool) {
+	if !enabled {
+		hc.cancellations = nil
+	}
+}
+
+// Rejects tasks whose endpoints the policy doesn't allow.
+func (hc *HttpController) SetEndpointPolicy(policy *EndpointPolicy) {
+	hc.endpointPolicy = policy
+}
+
+// Sets the default thresholds DeadLetterAlertHandler checks the DLQ against.
+func (hc *HttpController) SetDeadLetterThresholds(thresholds DeadLetterThresholds) {
+	hc.deadLetterThresholds = thresholds
+}
+
 func (hc *HttpController) respondError(w http.ResponseWriter, statusCode int, message string) {
 	w.WriteHeader(statusCode)
 	w.Header()["Content-Type"] = []string{"application/json"}
 	w.Write(NewJsonError(http.StatusText(statusCode), message).Json())
 }
 
+func (hc *HttpController) respondJson(w http.ResponseWriter, statusCode int, v interface{}) {
+	aJson, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	w.Header()["Content-Type"] = []string{"application/json"}
+	w.WriteHeader(statusCode)
+	w.Write(aJson)
+}
+
+// Reads a non-negative integer query parameter, falling back to the default
+// when it isn't given.
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+
+	return i, nil
+}
+
 func (hc *HttpController) HttpHandler(w http.ResponseWriter, r *http.Request) {
 	requestStartTime := time.Now()
+	queueName, ok := hc.resolveQueue(w, r)
+	if !ok {
+		return
+	}
+
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		hc.respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	payload, err := NewRMQPayload(body)
-	if err != nil {
+	payload, err := NewRMQPayloadWithPolicy(body, hc.endpointPolicy)
+	if errors.Is(err, ErrEndpointNotAllowed) {
+		hc.respondError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
 		hc.respondError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
+	if credential := CredentialFromContext(r.Context()); credential != nil && !credential.AllowsEndpoint(payload.Endpoint) {
+		msg := fmt.Sprintf("Credential %s may not send tasks to %s", credential.Name, payload.Endpoint)
+		hc.respondError(w, http.StatusForbidden, msg)
+		return
+	}
+
+	ctx, span := tracer.Start(traceContextFromRequest(r), "rmqhttp.enqueue",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(queueTraceAttribute.String(queueName), endpointTraceAttribute.String(payload.Endpoint)),
+	)
+	defer span.End()
+
 	// Note: Retries stays in the body.
 	// There may eventually be a need to rewrite the body; it can be
 	//   omitted if that ever happens.
@@ -82,61 +285,260 @@ func (hc *HttpController) HttpHandler(w http.ResponseWriter, r *http.Request) {
 		retryDelayHeaderName: payload.Backoff,
 	}
 
-	channel, err := hc.rmq.LockChannel()
-	if err != nil {
+	// Scheduled tasks go through the delay infrastructure, the same way
+	//   retries do, and land on the queue once their delay has passed.
+	exchange, routingKey := "", queueName
+	delay := payload.DelaySeconds(requestStartTime)
+	if delay > DelayInfrastructureMaxDelay {
+		msg := fmt.Sprintf("task is scheduled more than %d seconds in the future", DelayInfrastructureMaxDelay)
+		hc.respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+	span.SetAttributes(delayTraceAttribute.Int64(delay))
+
+	if delay > 0 {
+		exchange, routingKey = DelayRoutingExchange(), DelayRoutingKey(queueName, delay)
+	}
+
+	taskId := payload.Id
+	if taskId == "" {
+		taskId = uuid.NewString()
+	}
+	span.SetAttributes(taskIdTraceAttribute.String(taskId))
+
+	idempotencyKey := r.Header.Get(IdempotencyKeyHeaderName)
+	if idempotencyKey == "" {
+		idempotencyKey = payload.IdempotencyKey
+	}
+
+	storeKey := idempotencyStoreKey(CredentialFromContext(r.Context()), queueName, idempotencyKey)
+	if idempotencyKey != "" {
+		existingTaskId, claimed, err := hc.idempotency.Claim(storeKey, taskId)
+		if errors.Is(err, ErrIdempotencyKeyPending) {
+			// Answering with the task ID now would claim a task that may
+			//   still fail to publish.
+			w.Header().Set("Retry-After", "1")
+			hc.respondError(w, http.StatusConflict, err.Error())
+			return
+		} else if err != nil {
+			log.Error(err)
+			hc.respondError(w, http.StatusServiceUnavailable, "Failed to check idempotency key")
+			return
+		}
+
+		if !claimed {
+			log.WithFields(log.Fields{queueLogField: queueName, taskIdLogField: existingTaskId}).Debug("Idempotency key was already used")
+			w.Header().Set(TaskIdHeaderName, existingTaskId)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		headers[idempotencyKeyAmqpHeaderName] = idempotencyKey
+	}
+
+	injectTraceContext(ctx, headers)
+
+	// The queue is only declared once the request is known to be good, so
+	//   that rejected requests can't leave queues behind.
+	if _, err := hc.rmq.PrepareQueue(queueName); err != nil {
+		if idempotencyKey != "" {
+			hc.idempotency.Release(storeKey)
+		}
+
+		failSpan(span, err)
 		log.Error(err)
-		hc.respondError(w, http.StatusInternalServerError, "Failed to lock channel")
+		hc.respondError(w, http.StatusServiceUnavailable, "Failed to prepare queue")
 		return
 	}
-	defer hc.rmq.UnlockChannel(channel)
-	err = channel.Publish(
-		"",
-		hc.queue.Name,
-		false,
-		false,
+
+	err = hc.publish(
+		exchange,
+		routingKey,
 		amqp.Publishing{
-			ContentType: "application/json",
-			Body:        body,
-			Headers:     headers,
+			MessageId:    taskId,
+			ContentType:  "application/json",
+			DeliveryMode: payload.DeliveryMode(hc.persistentByDefault),
+			Body:         body,
+			Headers:      headers,
 		},
 	)
-
+	ingestDuration.WithLabelValues(queueName).Observe(time.Since(requestStartTime).Seconds())
 	if err != nil {
-		log.Fatal(err)
+		publishFailuresTotal.WithLabelValues(queueName).Inc()
+		if idempotencyKey != "" {
+			hc.idempotency.Release(storeKey)
+		}
+
+		failSpan(span, err)
+		log.Error(err)
+		hc.respondError(w, http.StatusServiceUnavailable, fmt.Sprintf("Failed to publish message: %s", err))
+		return
+	}
+
+	publishesTotal.WithLabelValues(queueName).Inc()
+
+	if idempotencyKey != "" {
+		if err := hc.idempotency.Confirm(storeKey); err != nil {
+			// The task is safely queued, so this is still a success; only
+			//   other replicas may miss the key.
+			log.Warnf("Failed to share idempotency key %s: %s", idempotencyKey, err)
+		}
+	}
+
+	log.WithFields(log.Fields{
+		queueLogField:    queueName,
+		taskIdLogField:   taskId,
+		endpointLogField: payload.Endpoint,
+		durationLogField: time.Since(requestStartTime).Milliseconds(),
+		"payload_bytes":  len(payload.Content),
+		"delay_seconds":  delay,
+	}).Debug("Published task")
+
+	w.Header().Set(TaskIdHeaderName, taskId)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Records the task as cancelled, so that workers will drop it instead of
+// delivering it, whether it's still waiting in a queue or in the delay
+// infrastructure.
+// Tasks that have already been delivered are unaffected.
+func (hc *HttpController) CancelTaskHandler(w http.ResponseWriter, r *http.Request) {
+	taskId := mux.Vars(r)[TaskIdRouteVariable]
+	if taskId == "" {
+		hc.respondError(w, http.StatusBadRequest, "no task id given")
+		return
 	}
 
-	requestDuration := time.Since(requestStartTime)
-	log.Debugf("Published to queue: %s; %07d byte payload in %05dms to: %s",
-		hc.queue.Name, len(payload.Content), requestDuration.Milliseconds(), payload.Endpoint)
+	// Task IDs don't say which queue or endpoint a task is for, so only
+	//   credentials that may use every queue and endpoint can cancel them.
+	if credential := CredentialFromContext(r.Context()); credential != nil && !credential.HasFullAccess() {
+		msg := fmt.Sprintf("Credential %s may not cancel tasks", credential.Name)
+		hc.respondError(w, http.StatusForbidden, msg)
+		return
+	}
 
+	err := hc.cancellations.Cancel(taskId)
+	if errors.Is(err, ErrCancellationsDisabled) {
+		hc.respondError(w, http.StatusNotImplemented, err.Error())
+		return
+	} else if err != nil {
+		log.Error(err)
+		hc.respondError(w, http.StatusServiceUnavailable, fmt.Sprintf("Failed to cancel task: %s", err))
+		return
+	}
+
+	log.WithField(taskIdLogField, taskId).Debug("Cancelled task")
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func (hc *HttpController) HealthHandler(w http.ResponseWriter, r *http.Request) {
+// Fails only when the connection to RMQ is down, or has been closed; a
+// restart can't fix anything else.
+func (hc *HttpController) LivenessHandler(w http.ResponseWriter, r *http.Request) {
+	if hc.rmq.IsClosed() || !hc.rmq.IsConnected() {
+		hc.respondError(w, http.StatusServiceUnavailable, "Not connected to RMQ")
+		return
+	}
+}
+
+// Fails when a channel can't be locked, or when the queue hasn't been
+// declared.
+func (hc *HttpController) ReadinessHandler(w http.ResponseWriter, r *http.Request) {
+	queueName, ok := hc.resolveQueue(w, r)
+	if !ok {
+		return
+	}
+
 	channel, err := hc.rmq.LockChannel()
 	if err != nil {
-		hc.respondError(w, http.StatusInternalServerError, "Failed to lock channel")
+		hc.respondError(w, http.StatusServiceUnavailable, "Failed to lock channel")
 		return
 	}
-	defer hc.rmq.UnlockChannel(channel)
 
-	queue := DeadLetterQueueName(hc.queue.Name)
+	// A failed passive declare closes the channel, so it can't go back to
+	//   the pool.
+	if _, err := channel.QueueInspect(queueName); err != nil {
+		hc.rmq.DiscardChannel(channel)
+		log.Error(err)
+		hc.respondError(w, http.StatusServiceUnavailable, fmt.Sprintf("Queue %s is not declared", queueName))
+		return
+	}
+
+	hc.rmq.UnlockChannel(channel)
+}
 
-	queueInspect, err := channel.QueueInspect(queue)
+// Returns the request's credential if it's limited to some endpoint hosts,
+// and nil if there's no credential, or it may use any host.
+func hostScopedCredential(r *http.Request) *Credential {
+	credential := CredentialFromContext(r.Context())
+	if credential == nil || credential.allowsEverything(credential.Hosts) {
+		return nil
+	}
+
+	return credential
+}
+
+// Responds with an error if the request's credential is limited to some
+// endpoint hosts.
+// Needed for responses that describe a whole queue, which holds tasks for any
+// number of hosts.
+func (hc *HttpController) requireAllHosts(w http.ResponseWriter, r *http.Request) bool {
+	if credential := hostScopedCredential(r); credential != nil {
+		msg := fmt.Sprintf("Credential %s may not inspect queues shared with other hosts", credential.Name)
+		hc.respondError(w, http.StatusForbidden, msg)
+		return false
+	}
+
+	return true
+}
+
+// Checks the DLQ against the configured thresholds, which the max_depth and
+// max_age query parameters override.
+// Responds 500 when any threshold is exceeded, so it can drive alerts
+// without taking part in liveness or readiness.
+func (hc *HttpController) DeadLetterAlertHandler(w http.ResponseWriter, r *http.Request) {
+	queueName, ok := hc.resolveQueue(w, r)
+	if !ok || !hc.requireAllHosts(w, r) {
+		return
+	}
+
+	thresholds := hc.deadLetterThresholds
+	maxDepth, err := queryInt(r, "max_depth", thresholds.MaxDepth)
+	if err != nil {
+		hc.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	thresholds.MaxDepth = maxDepth
+
+	if value := r.URL.Query().Get("max_age"); value != "" {
+		maxAge, err := time.ParseDuration(value)
+		if err != nil || maxAge < 0 {
+			hc.respondError(w, http.StatusBadRequest, "max_age must be a non-negative duration")
+			return
+		}
+		thresholds.MaxAge = maxAge
+	}
+
+	alert, err := hc.rmq.CheckDeadLetters(queueName, thresholds)
 	if err != nil {
 		log.Error(err)
 		hc.respondError(w, http.StatusInternalServerError, "Failed to inspect DLQ")
 		return
 	}
 
-	if queueInspect.Messages != 0 {
-		msg := fmt.Sprintf("DLQ has %d items", queueInspect.Messages)
-		hc.respondError(w, http.StatusInternalServerError, msg)
-		return
+	statusCode := http.StatusOK
+	if alert.Alerting() {
+		statusCode = http.StatusInternalServerError
 	}
+
+	hc.respondJson(w, statusCode, alert)
 }
 
 func (hc *HttpController) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	queueName, ok := hc.resolveQueue(w, r)
+	if !ok || !hc.requireAllHosts(w, r) {
+		return
+	}
+
 	if hc.managementUrl == nil {
 		log.Error("Management API not configured")
 		hc.respondError(w, http.StatusInternalServerError, "Management API not configured")
@@ -145,7 +547,7 @@ func (hc *HttpController) StatsHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Currently only supports default vhost.
 	u, _ := url.Parse(hc.managementUrl.String())
-	u.Path = path.Join(u.Path, "api", "queues", "%%2F", hc.queue.Name)
+	u.Path = path.Join(u.Path, "api", "queues", "%%2F", queueName)
 	fullManagementUrl := u.String()
 
 	client := &http.Client{}
@@ -171,14 +573,27 @@ func (hc *HttpController) StatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Prefetch of every consumer attached to the queue, so uneven limits
+	//   across worker replicas are easy to spot.
+	prefetch := []int{}
+	for _, consumer := range stats.ConsumerDetails {
+		prefetch = append(prefetch, consumer.PrefetchCount)
+	}
+
 	var statsRefined = struct {
-		Messages int
-		InRate   float32
-		OutRate  float32
+		Messages       int
+		Unacknowledged int
+		InRate         float32
+		OutRate        float32
+		Consumers      int
+		Prefetch       []int
 	}{
 		stats.Messages,
+		stats.MessagesUnacknowledged,
 		stats.MessageStats.PublishDetails.Rate,
 		stats.MessageStats.AckDetails.Rate,
+		stats.Consumers,
+		prefetch,
 	}
 
 	aJson, err := json.Marshal(statsRefined)
@@ -190,3 +605,133 @@ func (hc *HttpController) StatsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header()["Content-Type"] = []string{"application/json"}
 	w.Write(aJson)
 }
+
+// Lists the queue's dead letters, a page at a time, using the offset and
+// limit query parameters.
+func (hc *HttpController) DeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	queueName, ok := hc.resolveQueue(w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		hc.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	limit, err := queryInt(r, "limit", 20)
+	if err != nil {
+		hc.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if limit > MaxDeadLetterPageSize {
+		msg := fmt.Sprintf("limit must be at most %d", MaxDeadLetterPageSize)
+		hc.respondError(w, http.StatusBadRequest, msg)
+		return
+	}
+
+	page, err := hc.rmq.ListDeadLetters(queueName, offset, limit)
+	if err != nil {
+		log.Error(err)
+		hc.respondError(w, http.StatusInternalServerError, "Failed to read DLQ")
+		return
+	}
+
+	// Dead letters carry the whole task, headers and all, so credentials
+	//   limited to some hosts only get to see their own.
+	if credential := hostScopedCredential(r); credential != nil {
+		page.RemoveDisallowed(credential)
+	}
+
+	hc.respondJson(w, http.StatusOK, page)
+}
+
+// Moves dead letters back onto the queue; see deadLetterFilterFromQuery for
+// how to pick which.
+func (hc *HttpController) ReplayDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	hc.processDeadLetters(w, r, hc.rmq.ReplayDeadLetters)
+}
+
+// Drops dead letters; see deadLetterFilterFromQuery for how to pick which.
+func (hc *HttpController) PurgeDeadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	hc.processDeadLetters(w, r, hc.rmq.PurgeDeadLetters)
+}
+
+func (hc *HttpController) processDeadLetters(w http.ResponseWriter, r *http.Request, process func(string, DeadLetterFilter, bool) (*DeadLetterResult, error)) {
+	queueName, ok := hc.resolveQueue(w, r)
+	if !ok {
+		return
+	}
+
+	filter, dryRun, err := deadLetterFilterFromQuery(r)
+	if err != nil {
+		hc.respondError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// A DLQ holds tasks for any number of hosts, so credentials limited to
+	//   some hosts have to pick one of them.
+	if credential := hostScopedCredential(r); credential != nil {
+		if filter.EndpointHost == "" || !credential.AllowsHost(filter.EndpointHost) {
+			msg := fmt.Sprintf("Credential %s must give a host it may use", credential.Name)
+			hc.respondError(w, http.StatusForbidden, msg)
+			return
+		}
+	}
+
+	result, err := process(queueName, filter, dryRun)
+	if err != nil && result != nil {
+		// Some tasks may already have been handled, and there's no getting
+		//   them back, so say which.
+		log.Error(err)
+		result.Error = err.Error()
+		hc.respondJson(w, http.StatusInternalServerError, result)
+		return
+	} else if err != nil {
+		log.Error(err)
+		hc.respondError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to process DLQ: %s", err))
+		return
+	}
+
+	hc.respondJson(w, http.StatusOK, result)
+}
+
+// Reads the host, older_than, newer_than, and limit query parameters into a
+// filter, along with dry_run.
+// Ages are durations, like 1h30m.
+func deadLetterFilterFromQuery(r *http.Request) (DeadLetterFilter, bool, error) {
+	query := r.URL.Query()
+	filter := DeadLetterFilter{EndpointHost: query.Get("host")}
+
+	for name, age := range map[string]*time.Duration{"older_than": &filter.OlderThan, "newer_than": &filter.NewerThan} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return filter, false, fmt.Errorf("%s must be a duration", name)
+		}
+
+		*age = d
+	}
+
+	limit, err := queryInt(r, "limit", 0)
+	if err != nil {
+		return filter, false, err
+	}
+	filter.Limit = limit
+
+	dryRun := false
+	if value := query.Get("dry_run"); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			return filter, false, fmt.Errorf("dry_run must be a boolean")
+		}
+	}
+
+	return filter, dryRun, nil
+}
@@ -0,0 +1,300 @@
+package rmqhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHttpHandlerValidatesBeforePreparingQueue(t *testing.T) {
+	hc := NewHttpController()
+
+	var tests = []struct {
+		name       string
+		body       string
+		credential *Credential
+		statusCode int
+	}{
+		{"Invalid JSON", `{`, nil, http.StatusBadRequest},
+		{"No Endpoint", `{}`, nil, http.StatusBadRequest},
+		{"Timeout Too Long", `{"Endpoint": "http://example.com", "Timeout": 3601}`, nil, http.StatusBadRequest},
+		{"Too Far Away", `{"Endpoint": "http://example.com", "NotBefore": "2999-01-01T00:00:00Z"}`, nil, http.StatusBadRequest},
+		{"Endpoint Not Allowed", `{"Endpoint": "http://example.com"}`, &Credential{Name: "c", Queues: []string{"*"}, Hosts: []string{"example.org"}}, http.StatusForbidden},
+		// Not connected, so only valid requests get as far as preparing
+		//   the queue.
+		{"Valid", `{"Endpoint": "http://example.com"}`, nil, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/queues/q", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+			if tt.credential != nil {
+				r = withCredential(r, tt.credential)
+			}
+
+			rw := httptest.NewRecorder()
+			hc.HttpHandler(rw, r)
+			assert.Equal(t, tt.statusCode, rw.Code)
+		})
+	}
+}
+
+func TestHttpHandlerReleasesKeyWhenQueueCantBePrepared(t *testing.T) {
+	hc := NewHttpController()
+
+	r := httptest.NewRequest("POST", "/queues/q", strings.NewReader(`{"Endpoint": "http://example.com"}`))
+	r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+	r.Header.Set(IdempotencyKeyHeaderName, "key")
+
+	rw := httptest.NewRecorder()
+	hc.HttpHandler(rw, r)
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	_, claimed, err := hc.idempotency.Claim(idempotencyStoreKey(nil, "q", "key"), "task")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+}
+
+func TestHttpHandlerIdempotencyKeyScope(t *testing.T) {
+	tenant := &Credential{Name: "tenant", Queues: []string{"*"}, Hosts: []string{"*"}}
+	other := &Credential{Name: "other", Queues: []string{"*"}, Hosts: []string{"*"}}
+
+	var tests = []struct {
+		name       string
+		credential *Credential
+		queue      string
+		statusCode int
+		taskId     string
+	}{
+		{"Same Credential And Queue", tenant, "q", http.StatusNoContent, "task-1"},
+		// Not connected, so tasks that aren't duplicates fail to publish.
+		{"Other Queue", tenant, "other-q", http.StatusServiceUnavailable, ""},
+		{"Other Credential", other, "q", http.StatusServiceUnavailable, ""},
+		{"No Credential", nil, "q", http.StatusServiceUnavailable, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHttpController()
+			storeKey := idempotencyStoreKey(tenant, "q", "key")
+			_, _, err := hc.idempotency.Claim(storeKey, "task-1")
+			assert.NoError(t, err)
+			assert.NoError(t, hc.idempotency.Confirm(storeKey))
+
+			r := httptest.NewRequest("POST", "/queues/"+tt.queue, strings.NewReader(`{"Endpoint": "http://example.com"}`))
+			r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: tt.queue})
+			r.Header.Set(IdempotencyKeyHeaderName, "key")
+			if tt.credential != nil {
+				r = withCredential(r, tt.credential)
+			}
+
+			rw := httptest.NewRecorder()
+			hc.HttpHandler(rw, r)
+			assert.Equal(t, tt.statusCode, rw.Code)
+			assert.Equal(t, tt.taskId, rw.Header().Get(TaskIdHeaderName))
+		})
+	}
+}
+
+func TestHttpHandlerPublish(t *testing.T) {
+	var tests = []struct {
+		name       string
+		err        error
+		statusCode int
+	}{
+		{"Confirmed", nil, http.StatusNoContent},
+		{"Nacked", ErrPublishNacked, http.StatusServiceUnavailable},
+		{"Timed Out", ErrPublishTimeout, http.StatusServiceUnavailable},
+		{"Channel Closed", errChannelClosed, http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHttpController()
+			hc.rmq.QueueCache["q"] = &amqp.Queue{Name: "q"}
+
+			var published amqp.Publishing
+			hc.publish = func(exchange, key string, msg amqp.Publishing) error {
+				assert.Equal(t, "q", key)
+				published = msg
+				return tt.err
+			}
+
+			r := httptest.NewRequest("POST", "/queues/q", strings.NewReader(`{"Endpoint": "http://example.com"}`))
+			r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+			r.Header.Set(IdempotencyKeyHeaderName, "key")
+
+			rw := httptest.NewRecorder()
+			hc.HttpHandler(rw, r)
+			assert.Equal(t, tt.statusCode, rw.Code)
+			assert.NotEmpty(t, published.MessageId)
+
+			// Tasks the broker didn't take can be sent again with the same
+			//   key.
+			_, claimed, err := hc.idempotency.Claim(idempotencyStoreKey(nil, "q", "key"), "task")
+			assert.NoError(t, err)
+			assert.Equal(t, tt.err != nil, claimed)
+
+			if tt.err == nil {
+				assert.Equal(t, published.MessageId, rw.Header().Get(TaskIdHeaderName))
+			}
+		})
+	}
+}
+
+func TestSetAllowedQueuesInvalid(t *testing.T) {
+	hc := NewHttpController()
+	assert.Error(t, hc.SetAllowedQueues([]string{"tasks-*", "["}))
+	assert.Nil(t, hc.allowedQueues)
+}
+
+func TestQueueAllowed(t *testing.T) {
+	var tests = []struct {
+		name     string
+		patterns []string
+		queue    string
+		allowed  bool
+	}{
+		{"No Patterns", nil, "anything", true},
+		{"Exact", []string{"other"}, "other", true},
+		{"Wildcard", []string{"tasks-*"}, "tasks-email", true},
+		{"Wildcard Mismatch", []string{"tasks-*"}, "jobs-email", false},
+		{"Wildcard Stops At Slash", []string{"tasks-*"}, "tasks-a/b", false},
+		{"Default Queue", []string{"tasks-*"}, "default", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHttpController()
+			hc.queue = &amqp.Queue{Name: "default"}
+			assert.NoError(t, hc.SetAllowedQueues(tt.patterns))
+			assert.Equal(t, tt.allowed, hc.queueAllowed(tt.queue))
+		})
+	}
+}
+
+func TestResolveQueue(t *testing.T) {
+	var tests = []struct {
+		name         string
+		defaultQueue string
+		routeQueue   string
+		credential   *Credential
+		queue        string
+		statusCode   int
+	}{
+		{"Default Queue", "default", "", nil, "default", http.StatusOK},
+		{"No Default Queue", "", "", nil, "", http.StatusNotFound},
+		{"Named Queue", "", "tasks-email", nil, "tasks-email", http.StatusOK},
+		{"Named Queue Not Allowed", "default", "jobs-email", nil, "", http.StatusForbidden},
+		{"Credential Allows Queue", "", "tasks-email", &Credential{Name: "c", Queues: []string{"tasks-*"}, Hosts: []string{"*"}}, "tasks-email", http.StatusOK},
+		{"Credential Denies Queue", "", "tasks-email", &Credential{Name: "c", Queues: []string{"other"}, Hosts: []string{"*"}}, "", http.StatusForbidden},
+		{"Credential Denies Default Queue", "default", "", &Credential{Name: "c", Queues: []string{"other"}, Hosts: []string{"*"}}, "", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHttpController()
+			assert.NoError(t, hc.SetAllowedQueues([]string{"tasks-*"}))
+			if tt.defaultQueue != "" {
+				hc.queue = &amqp.Queue{Name: tt.defaultQueue}
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.routeQueue != "" {
+				r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: tt.routeQueue})
+			}
+
+			if tt.credential != nil {
+				r = withCredential(r, tt.credential)
+			}
+
+			rw := httptest.NewRecorder()
+			queue, ok := hc.resolveQueue(rw, r)
+			assert.Equal(t, tt.statusCode == http.StatusOK, ok)
+			assert.Equal(t, tt.queue, queue)
+			assert.Equal(t, tt.statusCode, rw.Code)
+		})
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	var tests = []struct {
+		name  string
+		stats string
+		body  string
+	}{
+		{
+			"Consumers",
+			`{"messages": 3, "messages_unacknowledged": 2, "consumers": 2, "consumer_details": [{"prefetch_count": 10}, {"prefetch_count": 0}]}`,
+			`{"Messages": 3, "Unacknowledged": 2, "InRate": 0, "OutRate": 0, "Consumers": 2, "Prefetch": [10, 0]}`,
+		},
+		{
+			"No Consumers",
+			`{"messages": 3, "message_stats": {"publish_details": {"rate": 1.5}, "ack_details": {"rate": 0.5}}}`,
+			`{"Messages": 3, "Unacknowledged": 0, "InRate": 1.5, "OutRate": 0.5, "Consumers": 0, "Prefetch": []}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.stats))
+			}))
+			defer server.Close()
+
+			hc := NewHttpController()
+			hc.SetManagementConnectionString(server.URL)
+
+			r := httptest.NewRequest("GET", "/queues/q/stats", nil)
+			r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+
+			rw := httptest.NewRecorder()
+			hc.StatsHandler(rw, r)
+			assert.Equal(t, http.StatusOK, rw.Code)
+			assert.JSONEq(t, tt.body, rw.Body.String())
+		})
+	}
+}
+
+func TestProcessDeadLettersFailure(t *testing.T) {
+	var tests = []struct {
+		name   string
+		result *DeadLetterResult
+		body   string
+	}{
+		{
+			"Partway Through",
+			&DeadLetterResult{Queue: "q-dead-letter-queue", TaskIds: []string{"task-1"}},
+			`{"Queue": "q-dead-letter-queue", "DryRun": false, "TaskIds": ["task-1"], "Error": "broker rejected message"}`,
+		},
+		{
+			"Before Starting",
+			nil,
+			`{"Error": "Internal Server Error", "Message": "Failed to process DLQ: broker rejected message"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hc := NewHttpController()
+
+			r := httptest.NewRequest("POST", "/queues/q/dlq/replay", nil)
+			r = mux.SetURLVars(r, map[string]string{QueueRouteVariable: "q"})
+
+			rw := httptest.NewRecorder()
+			hc.processDeadLetters(rw, r, func(string, DeadLetterFilter, bool) (*DeadLetterResult, error) {
+				return tt.result, ErrPublishNacked
+			})
+			assert.Equal(t, http.StatusInternalServerError, rw.Code)
+			assert.JSONEq(t, tt.body, rw.Body.String())
+		})
+	}
+}
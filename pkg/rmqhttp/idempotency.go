@@ -0,0 +1,228 @@
+package rmqhttp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Request header producers can use to make retried POSTs safe.
+// It's also forwarded to the endpoint, so it can deduplicate on its end too.
+const IdempotencyKeyHeaderName = "Idempotency-Key"
+
+// AMQP header that carries the key from the server to the worker.
+const idempotencyKeyAmqpHeaderName = "x-idempotency-key"
+
+// Stream that RMQIdempotencyStore shares keys through, and the longest window
+// it can support.
+const IdempotencyStreamName = "rmqhttp-idempotency-keys"
+const MaxIdempotencyWindow = 7 * 24 * time.Hour
+
+var ErrIdempotencyKeyPending = errors.New("task with this idempotency key is still being published")
+
+// Remembers which task each idempotency key was used for.
+//
+// Claim records the key against the task, unless the key was already used
+// within the store's window, in which case the task it was used for is
+// returned instead.
+// Once the task has been published, the claim is either confirmed, or
+// released so that the key can be used again.
+// Until then, claiming the key again fails with ErrIdempotencyKeyPending,
+// since the task it was claimed for may never exist.
+type IdempotencyStore interface {
+	Claim(key, taskId string) (existingTaskId string, claimed bool, err error)
+	Confirm(key string) error
+	Release(key string)
+}
+
+// Stores that need the server's RMQ connection to work.
+type rmqBackedStore interface {
+	start(rmq *RMQ) error
+}
+
+// Keys are only unique to the credential and queue they were sent with, so
+// that tenants, or queues, that happen to pick the same key don't collide.
+func idempotencyStoreKey(credential *Credential, queueName, key string) string {
+	credentialName := ""
+	if credential != nil {
+		credentialName = credential.Name
+	}
+
+	return credentialName + "\x00" + queueName + "\x00" + key
+}
+
+type idempotencyRecord struct {
+	TaskId    string
+	ClaimedAt time.Time
+	Pending   bool
+}
+
+// Keeps keys in the memory of a single server.
+// Duplicates that land on different replicas won't be caught; use
+// RMQIdempotencyStore for that.
+type MemoryIdempotencyStore struct {
+	window time.Duration
+
+	lock       sync.Mutex
+	records    map[string]idempotencyRecord
+	lastPruned time.Time
+}
+
+func NewMemoryIdempotencyStore(window time.Duration) *MemoryIdempotencyStore {
+	store := MemoryIdempotencyStore{
+		window:     window,
+		records:    make(map[string]idempotencyRecord),
+		lastPruned: time.Now(),
+	}
+	return &store
+}
+
+func (mis *MemoryIdempotencyStore) Claim(key, taskId string) (string, bool, error) {
+	return mis.claim(key, taskId, time.Now(), true)
+}
+
+func (mis *MemoryIdempotencyStore) Confirm(key string) error {
+	mis.lock.Lock()
+	defer mis.lock.Unlock()
+	if record, ok := mis.records[key]; ok {
+		record.Pending = false
+		mis.records[key] = record
+	}
+
+	return nil
+}
+
+func (mis *MemoryIdempotencyStore) Release(key string) {
+	mis.lock.Lock()
+	defer mis.lock.Unlock()
+	delete(mis.records, key)
+}
+
+// Pending claims still need to be confirmed or released.
+func (mis *MemoryIdempotencyStore) claim(key, taskId string, claimedAt time.Time, pending bool) (string, bool, error) {
+	mis.lock.Lock()
+	defer mis.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(mis.lastPruned) > mis.window {
+		for k, record := range mis.records {
+			if now.Sub(record.ClaimedAt) > mis.window {
+				delete(mis.records, k)
+			}
+		}
+		mis.lastPruned = now
+	}
+
+	if record, ok := mis.records[key]; ok && now.Sub(record.ClaimedAt) <= mis.window {
+		if record.Pending {
+			return record.TaskId, false, ErrIdempotencyKeyPending
+		}
+
+		return record.TaskId, false, nil
+	}
+
+	mis.records[key] = idempotencyRecord{taskId, claimedAt, pending}
+	return taskId, true, nil
+}
+
+// Shares keys between server replicas through a RMQ stream.
+// Every replica follows the stream into its own MemoryIdempotencyStore, so
+// duplicates are caught wherever they land, as long as they're sent more than
+// the few milliseconds it takes a key to make it to every replica apart.
+type RMQIdempotencyStore struct {
+	rmq   *RMQ
+	local *MemoryIdempotencyStore
+
+	lock    sync.Mutex
+	pending map[string]string
+}
+
+func NewRMQIdempotencyStore(window time.Duration) (*RMQIdempotencyStore, error) {
+	if window > MaxIdempotencyWindow {
+		return nil, fmt.Errorf("idempotency window must be at most %s", MaxIdempotencyWindow)
+	}
+
+	store := RMQIdempotencyStore{
+		local:   NewMemoryIdempotencyStore(window),
+		pending: make(map[string]string),
+	}
+	return &store, nil
+}
+
+func (ris *RMQIdempotencyStore) start(rmq *RMQ) error {
+	ris.rmq = rmq
+	if err := rmq.DeclareStream(IdempotencyStreamName, MaxIdempotencyWindow); err != nil {
+		return err
+	}
+
+	go rmq.FollowStream(IdempotencyStreamName, func(delivery amqp.Delivery) {
+		record := struct{ Key, TaskId string }{}
+		if err := json.Unmarshal(delivery.Body, &record); err != nil {
+			log.Warnf("Ignoring invalid idempotency record: %s", err)
+			return
+		}
+
+		// Keys this replica claimed come back around too; those are
+		//   already recorded, so this won't replace them.
+		ris.local.claim(record.Key, record.TaskId, deliveryTimestamp(delivery), false)
+	})
+
+	return nil
+}
+
+func (ris *RMQIdempotencyStore) Claim(key, taskId string) (string, bool, error) {
+	existingTaskId, claimed, err := ris.local.Claim(key, taskId)
+	if err != nil || !claimed {
+		return existingTaskId, claimed, err
+	}
+
+	ris.lock.Lock()
+	defer ris.lock.Unlock()
+	ris.pending[key] = taskId
+	return taskId, true, nil
+}
+
+func (ris *RMQIdempotencyStore) Confirm(key string) error {
+	ris.lock.Lock()
+	taskId, ok := ris.pending[key]
+	delete(ris.pending, key)
+	ris.lock.Unlock()
+	if !ok {
+		return nil
+	}
+
+	if err := ris.local.Confirm(key); err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(struct{ Key, TaskId string }{key, taskId})
+	if err != nil {
+		return err
+	}
+
+	return ris.rmq.Publish(
+		"",
+		IdempotencyStreamName,
+		amqp.Publishing{
+			ContentType:  "application/json",
+			DeliveryMode: amqp.Persistent,
+			Timestamp:    time.Now(),
+			Body:         body,
+		},
+	)
+}
+
+func (ris *RMQIdempotencyStore) Release(key string) {
+	ris.lock.Lock()
+	delete(ris.pending, key)
+	ris.lock.Unlock()
+
+	ris.local.Release(key)
+}
@@ -0,0 +1,70 @@
+package rmqhttp
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Hour)
+
+	taskId, claimed, err := store.Claim("key", "task-1")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, "task-1", taskId)
+
+	taskId, claimed, err = store.Claim("key", "task-2")
+	assert.Equal(t, ErrIdempotencyKeyPending, err)
+	assert.False(t, claimed)
+	assert.Equal(t, "task-1", taskId)
+
+	assert.NoError(t, store.Confirm("key"))
+
+	taskId, claimed, err = store.Claim("key", "task-2")
+	assert.NoError(t, err)
+	assert.False(t, claimed)
+	assert.Equal(t, "task-1", taskId)
+
+	store.Release("key")
+
+	taskId, claimed, err = store.Claim("key", "task-3")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, "task-3", taskId)
+}
+
+func TestMemoryIdempotencyStoreWindow(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Hour)
+
+	_, claimed, err := store.claim("key", "task-1", time.Now().Add(-2*time.Hour), false)
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	taskId, claimed, err := store.Claim("key", "task-2")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, "task-2", taskId)
+}
+
+func TestMemoryIdempotencyStoreReleasePending(t *testing.T) {
+	store := NewMemoryIdempotencyStore(time.Hour)
+
+	_, claimed, err := store.Claim("key", "task-1")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+
+	_, _, err = store.Claim("key", "task-2")
+	assert.Equal(t, ErrIdempotencyKeyPending, err)
+
+	// A nacked publish releases the key, so the retry gets its own task.
+	store.Release("key")
+
+	taskId, claimed, err := store.Claim("key", "task-3")
+	assert.NoError(t, err)
+	assert.True(t, claimed)
+	assert.Equal(t, "task-3", taskId)
+}
@@ -0,0 +1,39 @@
+package rmqhttp
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Names of the fields attached to log lines about tasks, so they can be
+// indexed without parsing messages.
+const (
+	queueLogField            = "queue"
+	taskIdLogField           = "task_id"
+	endpointLogField         = "endpoint"
+	statusLogField           = "status"
+	durationLogField         = "duration_ms"
+	attemptLogField          = "attempt"
+	retriesRemainingLogField = "retries_remaining"
+	reasonLogField           = "reason"
+)
+
+// Fields that describe the delivery, as far as its headers go.
+// Attempts and retries are left out when their headers are missing or
+// invalid.
+func deliveryLogger(queue *amqp.Queue, delivery *amqp.Delivery) *log.Entry {
+	fields := log.Fields{
+		queueLogField:  queue.Name,
+		taskIdLogField: delivery.MessageId,
+	}
+
+	if attempts, err := ToInt(delivery.Headers[attemptsHeaderName]); err == nil {
+		fields[attemptLogField] = attempts + 1
+	}
+
+	if retries, err := ToInt(delivery.Headers[retriesHeaderName]); err == nil {
+		fields[retriesRemainingLogField] = retries
+	}
+
+	return log.WithFields(fields)
+}
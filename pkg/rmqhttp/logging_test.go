@@ -0,0 +1,32 @@
+package rmqhttp
+
+import (
+	"testing"
+)
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryLogger(t *testing.T) {
+	queue := &amqp.Queue{Name: "q"}
+
+	var tests = []struct {
+		name    string
+		headers amqp.Table
+		fields  log.Fields
+	}{
+		{"No Headers", amqp.Table{}, log.Fields{queueLogField: "q", taskIdLogField: "id"}},
+		{"First Attempt", amqp.Table{attemptsHeaderName: 0, retriesHeaderName: int32(3)}, log.Fields{queueLogField: "q", taskIdLogField: "id", attemptLogField: 1, retriesRemainingLogField: 3}},
+		{"Invalid Headers", amqp.Table{attemptsHeaderName: "two"}, log.Fields{queueLogField: "q", taskIdLogField: "id"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := &amqp.Delivery{MessageId: "id", Headers: tt.headers}
+			assert.Equal(t, tt.fields, deliveryLogger(queue, delivery).Data)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package rmqhttp
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Everything is registered with the default registry, so the server and the
+// worker both serve it from /metrics with promhttp.Handler.
+var (
+	publishesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmqhttp_publishes_total",
+		Help: "Tasks published to a queue by the server.",
+	}, []string{"queue"})
+
+	publishFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmqhttp_publish_failures_total",
+		Help: "Tasks the server failed to publish to a queue.",
+	}, []string{"queue"})
+
+	ingestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rmqhttp_ingest_duration_seconds",
+		Help:    "Time taken by the server to accept a task, including waiting for the broker to confirm it.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"queue"})
+
+	deliveryAttemptsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmqhttp_delivery_attempts_total",
+		Help: "HTTP requests made by the worker to deliver tasks.",
+	}, []string{"queue", "host"})
+
+	deliveryOutcomesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmqhttp_delivery_outcomes_total",
+		Help: "Results of delivery attempts, by status class; error means no response was received.",
+	}, []string{"queue", "host", "status_class"})
+
+	deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "rmqhttp_delivery_duration_seconds",
+		Help:    "Time taken by endpoints to respond to delivery attempts.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host"})
+
+	retriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmqhttp_retries_total",
+		Help: "Failed tasks scheduled for another attempt.",
+	}, []string{"queue"})
+
+	deadLettersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "rmqhttp_dead_letters_total",
+		Help: "Tasks sent to a dead letter queue.",
+	}, []string{"queue", "reason"})
+
+	channelPoolSize = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rmqhttp_channel_pool_size",
+		Help: "Idle channels waiting in the pool.",
+	})
+
+	openChannels = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "rmqhttp_open_channels",
+		Help: "Channels open on the current connection, pooled or in use.",
+	})
+)
+
+// Label for the host of an endpoint.
+// Endpoints are chosen by whoever submits tasks, so only the known hosts get
+// their own label; the rest are counted together as other, to keep the number
+// of series bounded.
+func endpointHost(endpoint string, knownHosts map[string]bool) string {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "invalid"
+	}
+
+	if !knownHosts[strings.ToLower(u.Host)] {
+		return "other"
+	}
+
+	return u.Host
+}
+
+// Label for the class of an HTTP status, like 2xx.
+func statusClass(status int) string {
+	if status == 0 {
+		return "error"
+	}
+
+	return strconv.Itoa(status/100) + "xx"
+}
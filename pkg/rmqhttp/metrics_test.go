@@ -0,0 +1,59 @@
+package rmqhttp
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEndpointHost(t *testing.T) {
+	var tests = []struct {
+		name     string
+		endpoint string
+		host     string
+	}{
+		{"Known Host", "https://api.example.com/tasks?id=1", "api.example.com"},
+		{"Known Host With Port", "http://localhost:8080/tasks", "localhost:8080"},
+		{"Known Host Other Case", "https://API.example.com/tasks", "API.example.com"},
+		{"Unknown Host", "https://attacker-1234.example.net/", "other"},
+		{"Known Host Other Port", "http://localhost:9090/tasks", "other"},
+		{"No Host", "/tasks", "invalid"},
+		{"Unparseable", "http://[::1", "invalid"},
+	}
+
+	w := NewWorker(nil)
+	w.SetMetricsHosts([]string{"api.example.com", "LOCALHOST:8080"})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.host, endpointHost(tt.endpoint, w.metricsHosts))
+		})
+	}
+}
+
+func TestEndpointHostNoKnownHosts(t *testing.T) {
+	assert.Equal(t, "other", endpointHost("https://api.example.com/", nil))
+}
+
+func TestStatusClass(t *testing.T) {
+	var tests = []struct {
+		name   string
+		status int
+		class  string
+	}{
+		{"No Response", 0, "error"},
+		{"Informational", 100, "1xx"},
+		{"Success", 204, "2xx"},
+		{"Redirect", 302, "3xx"},
+		{"Client Error", 429, "4xx"},
+		{"Server Error", 503, "5xx"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.class, statusClass(tt.status))
+		})
+	}
+}
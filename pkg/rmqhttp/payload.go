@@ -3,11 +3,25 @@ package rmqhttp
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
 )
 
 // Desribes the primary payload of the system.
 //
+// Id:           Identifies the task, so that it can be cancelled.
+// Defaults to a random UUID; at most 255 characters.
+//
 // Endpoint:     URL where the content will be sent.
+// Method:       HTTP method used to send the content.
+// Defaults to POST; must be one of AllowedMethods.
 // Content:      Payload to send in HTTP request.
 // Base64Decode: Whether or not the service needs to decode the given content
 // before sending it.
@@ -25,18 +39,68 @@ import (
 //
 // Timeout:      Number of seconds to wait before timing out the HTTP request.
 // Defaults to 60 seconds; maximum 3600 seconds.
+//
+// Persistent:   Whether the broker should write the task to disk, so that it
+// survives a broker restart.
+// Defaults to the server's setting, which is persistent unless it was started
+// with --transient.
+//
+// Delay:        Number of seconds to hold the task before the first attempt.
+// NotBefore:    RFC3339 time before which the first attempt won't be made.
+// At most one of the two may be given; by default, tasks are attempted right
+// away.
+//
+// SuccessCodes: Status codes that mean the endpoint accepted the task.
+// RetryCodes:   Status codes that mean the task should be tried again.
+// DeadLetterCodes: Status codes that send the task straight to the DLX.
+// Each defaults to the worker's setting, as does an empty list; see
+// StatusPolicy for how they combine.
+//
+// IdempotencyKey: Tasks sent with a key that was already used within the
+// server's idempotency window, by the same credential and for the same queue,
+// aren't enqueued again.
+// May also be given in the Idempotency-Key request header, which takes
+// precedence.
+// The key is forwarded to the endpoint in the Idempotency-Key header.
 type rmqPayload struct {
+	Id           string
 	Endpoint     string
+	Method       string
 	Content      string
 	Base64Decode bool
 	Retries      int
 	Headers      map[string]string
 	Backoff      int
 	Timeout      int
+	Persistent   *bool
+	Delay        int64
+	NotBefore    *time.Time
+
+	SuccessCodes    StatusCodeSet
+	RetryCodes      StatusCodeSet
+	DeadLetterCodes StatusCodeSet
+
+	IdempotencyKey string
+}
+
+var AllowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodOptions,
 }
 
 func NewRMQPayload(bytes []byte) (*rmqPayload, error) {
-	payload := rmqPayload{Retries: 2, Backoff: 1, Timeout: 60}
+	return NewRMQPayloadWithPolicy(bytes, nil)
+}
+
+// Same as NewRMQPayload, but also rejects payloads whose endpoint the policy
+// doesn't allow.
+func NewRMQPayloadWithPolicy(bytes []byte, policy *EndpointPolicy) (*rmqPayload, error) {
+	payload := rmqPayload{Method: http.MethodPost, Retries: 2, Backoff: 1, Timeout: 60}
 	if err := json.Unmarshal(bytes, &payload); err != nil {
 		return nil, errors.New("invalid JSON")
 	}
@@ -45,9 +109,71 @@ func NewRMQPayload(bytes []byte) (*rmqPayload, error) {
 		return nil, errors.New("no endpoint given")
 	}
 
+	if len(payload.Id) > 255 {
+		return nil, errors.New("id longer than 255 characters")
+	}
+
 	if payload.Retries < 0 || payload.Retries > 9 {
 		return nil, errors.New("retries not within (0, 9)")
 	}
 
+	if payload.Timeout <= 0 || payload.Timeout > 3600 {
+		return nil, errors.New("timeout not within (1, 3600)")
+	}
+
+	if payload.Delay < 0 || payload.Delay > DelayInfrastructureMaxDelay {
+		return nil, fmt.Errorf("delay not within (0, %d)", DelayInfrastructureMaxDelay)
+	}
+
+	if payload.Delay != 0 && payload.NotBefore != nil {
+		return nil, errors.New("only one of delay and not before may be given")
+	}
+
+	payload.Method = strings.ToUpper(payload.Method)
+	if !methodAllowed(payload.Method) {
+		return nil, fmt.Errorf("method %q not one of %s", payload.Method, strings.Join(AllowedMethods, ", "))
+	}
+
+	if err := policy.CheckEndpoint(payload.Endpoint); err != nil {
+		return nil, err
+	}
+
 	return &payload, nil
 }
+
+func (p *rmqPayload) DeliveryMode(persistentByDefault bool) uint8 {
+	persistent := persistentByDefault
+	if p.Persistent != nil {
+		persistent = *p.Persistent
+	}
+
+	if persistent {
+		return amqp.Persistent
+	}
+
+	return amqp.Transient
+}
+
+// Number of seconds from now that the first attempt should be held for.
+func (p *rmqPayload) DelaySeconds(now time.Time) int64 {
+	if p.NotBefore == nil {
+		return p.Delay
+	}
+
+	delay := p.NotBefore.Sub(now)
+	if delay <= 0 {
+		return 0
+	}
+
+	return int64(math.Ceil(delay.Seconds()))
+}
+
+func methodAllowed(method string) bool {
+	for _, allowed := range AllowedMethods {
+		if method == allowed {
+			return true
+		}
+	}
+
+	return false
+}
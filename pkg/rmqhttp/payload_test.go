@@ -0,0 +1,122 @@
+package rmqhttp
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewRMQPayloadMethod(t *testing.T) {
+	var tests = []struct {
+		name   string
+		body   string
+		method string
+	}{
+		{"Default", `{"Endpoint": "http://example.com"}`, "POST"},
+		{"Put", `{"Endpoint": "http://example.com", "Method": "PUT"}`, "PUT"},
+		{"Lowercase", `{"Endpoint": "http://example.com", "Method": "delete"}`, "DELETE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := NewRMQPayload([]byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.method, payload.Method)
+		})
+	}
+}
+
+func TestNewRMQPayloadInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		body string
+	}{
+		{"Not JSON", `{`},
+		{"No Endpoint", `{}`},
+		{"Too Many Retries", `{"Endpoint": "http://example.com", "Retries": 10}`},
+		{"Zero Timeout", `{"Endpoint": "http://example.com", "Timeout": 0}`},
+		{"Negative Timeout", `{"Endpoint": "http://example.com", "Timeout": -1}`},
+		{"Timeout Too Long", `{"Endpoint": "http://example.com", "Timeout": 3601}`},
+		{"Unknown Method", `{"Endpoint": "http://example.com", "Method": "CONNECT"}`},
+		{"Negative Delay", `{"Endpoint": "http://example.com", "Delay": -1}`},
+		{"Delay And Not Before", `{"Endpoint": "http://example.com", "Delay": 1, "NotBefore": "2023-06-01T12:00:00Z"}`},
+		{"Bad Not Before", `{"Endpoint": "http://example.com", "NotBefore": "tomorrow"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRMQPayload([]byte(tt.body))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestNewRMQPayloadTimeout(t *testing.T) {
+	var tests = []struct {
+		name    string
+		body    string
+		timeout int
+	}{
+		{"Default", `{"Endpoint": "http://example.com"}`, 60},
+		{"Shortest", `{"Endpoint": "http://example.com", "Timeout": 1}`, 1},
+		{"Longest", `{"Endpoint": "http://example.com", "Timeout": 3600}`, 3600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := NewRMQPayload([]byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.timeout, payload.Timeout)
+		})
+	}
+}
+
+func TestRMQPayloadDelaySeconds(t *testing.T) {
+	now := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name  string
+		body  string
+		delay int64
+	}{
+		{"No Delay", `{"Endpoint": "http://example.com"}`, 0},
+		{"Delay", `{"Endpoint": "http://example.com", "Delay": 90}`, 90},
+		{"Not Before", `{"Endpoint": "http://example.com", "NotBefore": "2023-06-01T13:00:00Z"}`, 3600},
+		{"Not Before Other Zone", `{"Endpoint": "http://example.com", "NotBefore": "2023-06-01T08:00:30-04:00"}`, 30},
+		{"Not Before In The Past", `{"Endpoint": "http://example.com", "NotBefore": "2023-06-01T11:00:00Z"}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := NewRMQPayload([]byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.delay, payload.DelaySeconds(now))
+		})
+	}
+}
+
+func TestRMQPayloadDeliveryMode(t *testing.T) {
+	var tests = []struct {
+		name                string
+		body                string
+		persistentByDefault bool
+		deliveryMode        uint8
+	}{
+		{"Persistent Default", `{"Endpoint": "http://example.com"}`, true, amqp.Persistent},
+		{"Transient Default", `{"Endpoint": "http://example.com"}`, false, amqp.Transient},
+		{"Persistent Override", `{"Endpoint": "http://example.com", "Persistent": true}`, false, amqp.Persistent},
+		{"Transient Override", `{"Endpoint": "http://example.com", "Persistent": false}`, true, amqp.Transient},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, err := NewRMQPayload([]byte(tt.body))
+			assert.NoError(t, err)
+			assert.Equal(t, tt.deliveryMode, payload.DeliveryMode(tt.persistentByDefault))
+		})
+	}
+}
@@ -1,82 +1,410 @@
 package rmqhttp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
+	"time"
 )
 
 import (
 	log "github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const retriesHeaderName string = "x-remaining-retries"
 const retryDelayHeaderName string = "x-retry-delay"
 const attemptsHeaderName string = "x-attempt-number"
 
+// Bounds for the delay between attempts to re-establish a lost connection.
+const reconnectMinDelay = time.Second
+const reconnectMaxDelay = 30 * time.Second
+
+const defaultPublishTimeout = 5 * time.Second
+
+var ErrNotConnected = errors.New("RMQ not connected")
+var ErrPublishNacked = errors.New("broker rejected message")
+var ErrPublishTimeout = errors.New("timed out waiting for broker to confirm message")
+var ErrTLSNeedsAmqps = errors.New("TLS options given, but connection string isn't amqps://")
+var errChannelClosed = errors.New("channel closed before message was confirmed")
+
+// Every channel handed out by LockChannel is in confirm mode; these are the
+// notifications the broker sends back on it.
+type channelState struct {
+	closures chan *amqp.Error
+	confirms chan amqp.Confirmation
+}
+
 type RMQ struct {
 	Connection       *amqp.Connection
 	Channels         []*amqp.Channel
 	ChannelQueueLock sync.Mutex
 	QueueCache       map[string]*amqp.Queue
+
+	// How long Publish waits for the broker to confirm a message.
+	PublishTimeout time.Duration
+
+	// Used to connect over TLS when set, which needs an amqps://
+	//   connection string; amqps:// connection strings use the system's CAs
+	//   when it isn't.
+	TLSConfig *tls.Config
+
+	connectionString string
+	closing          bool
+
+	// Every queue that has been prepared, on this connection or an earlier
+	//   one, so that they can all be prepared again after reconnecting.
+	preparedQueues map[string]bool
+
+	// Notifications for every channel opened on the current connection, so
+	//   that dead channels never make it back into the pool.
+	channelStates map[*amqp.Channel]*channelState
 }
 
 func NewRMQ() *RMQ {
-	rmq := RMQ{nil, nil, sync.Mutex{}, make(map[string]*amqp.Queue)}
+	rmq := RMQ{
+		QueueCache:     make(map[string]*amqp.Queue),
+		PublishTimeout: defaultPublishTimeout,
+		channelStates:  make(map[*amqp.Channel]*channelState),
+		preparedQueues: make(map[string]bool),
+	}
 	return &rmq
 }
 
+// Connects to RMQ, and keeps the connection alive for as long as the RMQ
+// isn't explicitly closed.
+// If the broker drops the connection, it will be redialed with an
+// exponential backoff, and every queue that was previously prepared will be
+// prepared again.
 func (rmq *RMQ) ConnectRMQ(connectionString string) error {
+	rmq.ChannelQueueLock.Lock()
+	defer rmq.ChannelQueueLock.Unlock()
+
 	if rmq.Connection == nil {
-		conn, err := amqp.Dial(connectionString)
+		conn, err := rmq.dial(connectionString)
 		if err != nil {
 			return err
 		}
 
-		rmq.Connection = conn
+		rmq.connectionString = connectionString
+		rmq.setConnection(conn)
 	}
 
 	return nil
 }
 
+// The TLS config is only used for amqps:// connection strings, so anything
+// else is refused rather than quietly connecting in plaintext.
+func (rmq *RMQ) dial(connectionString string) (*amqp.Connection, error) {
+	if rmq.TLSConfig != nil {
+		uri, err := amqp.ParseURI(connectionString)
+		if err != nil {
+			return nil, err
+		}
+
+		if uri.Scheme != "amqps" {
+			return nil, ErrTLSNeedsAmqps
+		}
+
+		return amqp.DialTLS(connectionString, rmq.TLSConfig)
+	}
+
+	return amqp.Dial(connectionString)
+}
+
+// Must be called with the ChannelQueueLock held.
+// The close notification is registered before anything else can happen on
+// the connection; one registered after the connection has already dropped
+// would just be closed, without saying why.
+func (rmq *RMQ) setConnection(conn *amqp.Connection) {
+	rmq.Connection = conn
+	rmq.Channels = nil
+	rmq.channelStates = make(map[*amqp.Channel]*channelState)
+	rmq.QueueCache = make(map[string]*amqp.Queue)
+	rmq.updateChannelMetrics()
+
+	go rmq.watchConnection(conn.NotifyClose(make(chan *amqp.Error, 1)))
+}
+
+func (rmq *RMQ) watchConnection(closures chan *amqp.Error) {
+	amqpErr := <-closures
+	if rmq.IsClosed() {
+		return
+	}
+
+	log.Errorf("RMQ connection lost: %v", amqpErr)
+	rmq.reconnect()
+}
+
+func (rmq *RMQ) reconnect() {
+	for attempt := 0; !rmq.IsClosed(); attempt++ {
+		time.Sleep(ReconnectDelay(attempt))
+
+		conn, err := rmq.dial(rmq.connectionString)
+		if err != nil {
+			log.Warnf("Failed to reconnect to RMQ: %s", err)
+			continue
+		}
+
+		rmq.ChannelQueueLock.Lock()
+		if rmq.closing {
+			rmq.ChannelQueueLock.Unlock()
+			conn.Close()
+			return
+		}
+
+		rmq.setConnection(conn)
+		rmq.ChannelQueueLock.Unlock()
+
+		log.Info("Reconnected to RMQ")
+		rmq.reprepareQueues(conn)
+		return
+	}
+}
+
+// Prepares every previously prepared queue on the new connection, retrying
+// the ones that fail with a backoff until they all succeed, or the
+// connection is replaced or closed.
+func (rmq *RMQ) reprepareQueues(conn *amqp.Connection) {
+	for attempt := 0; ; attempt++ {
+		queueNames := rmq.unpreparedQueues(conn)
+		if len(queueNames) == 0 {
+			return
+		}
+
+		if attempt != 0 {
+			time.Sleep(ReconnectDelay(attempt - 1))
+		}
+
+		for _, queueName := range queueNames {
+			if _, err := rmq.PrepareQueue(queueName); err != nil {
+				log.Errorf("Failed to prepare queue %s after reconnecting: %s", queueName, err)
+			}
+		}
+	}
+}
+
+// Lists the queues that were prepared before, but not yet on the
+// connection; nothing is listed once the connection isn't the current one.
+func (rmq *RMQ) unpreparedQueues(conn *amqp.Connection) []string {
+	rmq.ChannelQueueLock.Lock()
+	defer rmq.ChannelQueueLock.Unlock()
+	if rmq.closing || rmq.Connection != conn {
+		return nil
+	}
+
+	queueNames := []string{}
+	for queueName := range rmq.preparedQueues {
+		if _, ok := rmq.QueueCache[queueName]; !ok {
+			queueNames = append(queueNames, queueName)
+		}
+	}
+
+	sort.Strings(queueNames)
+	return queueNames
+}
+
+// Closes the connection, and stops any further attempts to reconnect.
+func (rmq *RMQ) Close() error {
+	rmq.ChannelQueueLock.Lock()
+	rmq.closing = true
+	conn := rmq.Connection
+	rmq.ChannelQueueLock.Unlock()
+
+	if conn == nil || conn.IsClosed() {
+		return nil
+	}
+
+	return conn.Close()
+}
+
+func (rmq *RMQ) IsClosed() bool {
+	rmq.ChannelQueueLock.Lock()
+	defer rmq.ChannelQueueLock.Unlock()
+	return rmq.closing
+}
+
+func (rmq *RMQ) IsConnected() bool {
+	rmq.ChannelQueueLock.Lock()
+	defer rmq.ChannelQueueLock.Unlock()
+	return rmq.Connection != nil && !rmq.Connection.IsClosed()
+}
+
 func (rmq *RMQ) LockChannel() (*amqp.Channel, error) {
 	rmq.ChannelQueueLock.Lock()
 	defer rmq.ChannelQueueLock.Unlock()
-	if len(rmq.Channels) == 0 {
-		return rmq.Connection.Channel()
+	if rmq.Connection == nil || rmq.Connection.IsClosed() {
+		return nil, ErrNotConnected
+	}
+
+	defer rmq.updateChannelMetrics()
+
+	for len(rmq.Channels) != 0 {
+		channel := rmq.Channels[0]
+		rmq.Channels = rmq.Channels[1:]
+		if rmq.channelIsOpen(channel) {
+			return channel, nil
+		}
 	}
 
-	channel := rmq.Channels[0]
-	rmq.Channels = rmq.Channels[1:]
+	channel, err := rmq.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := channel.Confirm(false); err != nil {
+		channel.Close()
+		return nil, err
+	}
+
+	// Confirms are buffered so that one arriving after Publish has given up on
+	//   it can't block the connection before the channel is discarded.
+	rmq.channelStates[channel] = &channelState{
+		closures: channel.NotifyClose(make(chan *amqp.Error, 1)),
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+	}
 	return channel, nil
 }
 
+// Returns the channel to the pool.
+// Channels that have since been closed, or that belong to a connection that
+// has been replaced, are dropped instead.
 func (rmq *RMQ) UnlockChannel(channel *amqp.Channel) {
 	rmq.ChannelQueueLock.Lock()
 	defer rmq.ChannelQueueLock.Unlock()
+	defer rmq.updateChannelMetrics()
+	if !rmq.channelIsOpen(channel) {
+		return
+	}
+
 	rmq.Channels = append(rmq.Channels, channel)
 }
 
+// Closes a channel that was taken from LockChannel without returning it to
+// the pool.
+func (rmq *RMQ) DiscardChannel(channel *amqp.Channel) {
+	rmq.ChannelQueueLock.Lock()
+	delete(rmq.channelStates, channel)
+	rmq.updateChannelMetrics()
+	rmq.ChannelQueueLock.Unlock()
+
+	channel.Close()
+}
+
+// Must be called with the ChannelQueueLock held.
+func (rmq *RMQ) updateChannelMetrics() {
+	channelPoolSize.Set(float64(len(rmq.Channels)))
+	openChannels.Set(float64(len(rmq.channelStates)))
+}
+
+// Must be called with the ChannelQueueLock held.
+func (rmq *RMQ) channelIsOpen(channel *amqp.Channel) bool {
+	state, ok := rmq.channelStates[channel]
+	if !ok {
+		return false
+	}
+
+	select {
+	case <-state.closures:
+		delete(rmq.channelStates, channel)
+		return false
+	default:
+		return true
+	}
+}
+
+// Publishes a message on a pooled channel, and waits up to PublishTimeout for
+// the broker to confirm that it has taken responsibility for it.
+// A nil return means the message has been persisted by the broker.
+func (rmq *RMQ) Publish(exchange, key string, msg amqp.Publishing) error {
+	channel, err := rmq.LockChannel()
+	if err != nil {
+		return err
+	}
+
+	rmq.ChannelQueueLock.Lock()
+	state, ok := rmq.channelStates[channel]
+	rmq.ChannelQueueLock.Unlock()
+	if !ok {
+		return errChannelClosed
+	}
+
+	if err := channel.Publish(exchange, key, false, false, msg); err != nil {
+		rmq.DiscardChannel(channel)
+		return err
+	}
+
+	reusable, err := waitForConfirm(state.confirms, rmq.PublishTimeout)
+	if reusable {
+		rmq.UnlockChannel(channel)
+	} else {
+		rmq.DiscardChannel(channel)
+	}
+
+	return err
+}
+
+// Waits for the broker to confirm a single message, and says whether the
+// channel it was published on can go back to the pool.
+// Channels that time out can't, otherwise their late confirm would be read
+// by the next publisher.
+func waitForConfirm(confirms <-chan amqp.Confirmation, timeout time.Duration) (bool, error) {
+	select {
+	case confirmation, ok := <-confirms:
+		if !ok {
+			return false, errChannelClosed
+		}
+
+		if !confirmation.Ack {
+			return true, ErrPublishNacked
+		}
+	case <-time.After(timeout):
+		return false, ErrPublishTimeout
+	}
+
+	return true, nil
+}
+
+func ReconnectDelay(attempt int) time.Duration {
+	delay := reconnectMinDelay * time.Duration(math.Pow(2, float64(attempt)))
+	if delay <= 0 || delay > reconnectMaxDelay {
+		return reconnectMaxDelay
+	}
+
+	return delay
+}
+
 func DeadLetterQueueName(queue string) string {
 	return fmt.Sprintf("%s-dead-letter-queue", queue)
 }
 
+func DeadLetterExchangeName(queue string) string {
+	return fmt.Sprintf("%s-dead-letter-exchange", queue)
+}
+
 // Create the queue we need, and make sure it has a dead letter queue set up.
 // This could eventually take in specific configurations that workers/server
 // set up.
 func (rmq *RMQ) PrepareQueue(queueName string) (*amqp.Queue, error) {
+	rmq.ChannelQueueLock.Lock()
+	queue, ok := rmq.QueueCache[queueName]
+	rmq.ChannelQueueLock.Unlock()
+	if ok {
+		return queue, nil
+	}
+
 	channel, err := rmq.LockChannel()
 	if err != nil {
 		return nil, fmt.Errorf("cannot validate queue. RMQ not connected")
 	}
 	defer rmq.UnlockChannel(channel)
 
-	if queue, ok := rmq.QueueCache[queueName]; ok {
-		return queue, nil
-	}
-
-	dlxName := fmt.Sprintf("%s-dead-letter-exchange", queueName)
+	dlxName := DeadLetterExchangeName(queueName)
 	dlqName := DeadLetterQueueName(queueName)
 	delayxName := fmt.Sprintf("%s-delay-delivery", queueName)
 
@@ -93,7 +421,7 @@ func (rmq *RMQ) PrepareQueue(queueName string) (*amqp.Queue, error) {
 	}
 
 	args := amqp.Table{"x-dead-letter-exchange": dlxName}
-	queue, err := channel.QueueDeclare(queueName, true, false, false, false, args)
+	declaredQueue, err := channel.QueueDeclare(queueName, true, false, false, false, args)
 	if err != nil {
 		return nil, err
 	}
@@ -113,24 +441,36 @@ func (rmq *RMQ) PrepareQueue(queueName string) (*amqp.Queue, error) {
 		return nil, err
 	}
 
-	rmq.QueueCache[queue.Name] = &queue
+	rmq.ChannelQueueLock.Lock()
+	rmq.QueueCache[declaredQueue.Name] = &declaredQueue
+	rmq.preparedQueues[declaredQueue.Name] = true
+	rmq.ChannelQueueLock.Unlock()
 
-	return &queue, nil
+	return &declaredQueue, nil
 }
 
-func (rmq *RMQ) RequeueOrNack(queue *amqp.Queue, delivery *amqp.Delivery) {
+func (rmq *RMQ) RequeueOrNack(queue *amqp.Queue, delivery *amqp.Delivery, failure *DeliveryFailure) {
+	rmq.RequeueOrNackAfter(queue, delivery, -1, failure)
+}
+
+// Same as RequeueOrNack, but waits delaySeconds before the next attempt
+// instead of the delivery's exponential backoff, such as when the endpoint
+// said when to come back with Retry-After.
+// A negative delay uses the backoff.
+func (rmq *RMQ) RequeueOrNackAfter(queue *amqp.Queue, delivery *amqp.Delivery, delaySeconds int64, failure *DeliveryFailure) {
+	logger := deliveryLogger(queue, delivery)
 	retries, ok := delivery.Headers[retriesHeaderName]
 	if !ok {
 		// I guess assume that the retries have been exhausted?
-		log.Warn("Retries header not found")
-		delivery.Nack(false, false)
+		logger.Warn("Retries header not found")
+		rmq.DeadLetter(queue, delivery, "retries header not found", failure)
 		return
 	}
 
 	retriesInt, err := ToInt(retries)
 	if err != nil {
-		log.Error(err)
-		delivery.Nack(false, false)
+		logger.WithError(err).Error("Invalid retry headers")
+		rmq.DeadLetter(queue, delivery, "invalid retries header", failure)
 		return
 	}
 
@@ -141,8 +481,8 @@ func (rmq *RMQ) RequeueOrNack(queue *amqp.Queue, delivery *amqp.Delivery) {
 
 	attemptsInt, err := ToInt(attempts)
 	if err != nil {
-		log.Error(err)
-		delivery.Nack(false, false)
+		logger.WithError(err).Error("Invalid retry headers")
+		rmq.DeadLetter(queue, delivery, "invalid attempts header", failure)
 		return
 	}
 
@@ -153,49 +493,119 @@ func (rmq *RMQ) RequeueOrNack(queue *amqp.Queue, delivery *amqp.Delivery) {
 
 	backoffInt, err := ToInt(backoff)
 	if err != nil {
-		log.Error(err)
-		delivery.Nack(false, false)
+		logger.WithError(err).Error("Invalid retry headers")
+		rmq.DeadLetter(queue, delivery, "invalid retry delay header", failure)
 		return
 	}
 
 	if retriesInt <= 0 {
-		log.Info("Message failed final retry. Sending to DLX.")
-		delivery.Nack(false, false)
+		logger.Info("Message failed final retry. Sending to DLX.")
+		rmq.DeadLetter(queue, delivery, "retries exhausted", failure)
 		return
 	}
 
+	recordFailure(delivery.Headers, attemptsInt, failure, time.Now())
 	delivery.Headers[retriesHeaderName] = retriesInt - 1
 	delivery.Headers[attemptsHeaderName] = attemptsInt + 1
 	delivery.Headers[retryDelayHeaderName] = backoffInt
 
 	// Publish this message back to the queue and Ack the one with the current
 	//   retry count.
-	channel, err := rmq.LockChannel()
-	if err != nil {
-		log.Info("Failed to lock channel for requeuing delivery.")
-		delivery.Nack(false, true)
-		return
+	delay := delaySeconds
+	if delay < 0 {
+		delay = int64(backoffInt) * int64(math.Pow(2, float64(attemptsInt)))
+	}
+
+	if delay > DelayInfrastructureMaxDelay {
+		delay = DelayInfrastructureMaxDelay
 	}
-	defer rmq.UnlockChannel(channel)
 
-	delay := int64(backoffInt) * int64(math.Pow(2, float64(attemptsInt)))
-	err = channel.Publish(
+	span := startRetrySpan(queue, delivery, attemptsInt+2, delay)
+	defer span.End()
+
+	err = rmq.Publish(
 		DelayRoutingExchange(),
 		DelayRoutingKey(queue.Name, delay),
-		false,
-		false,
 		amqp.Publishing{
-			ContentType: delivery.ContentType,
-			Body:        delivery.Body,
-			Headers:     delivery.Headers,
+			MessageId:    delivery.MessageId,
+			ContentType:  delivery.ContentType,
+			DeliveryMode: delivery.DeliveryMode,
+			Body:         delivery.Body,
+			Headers:      delivery.Headers,
 		},
 	)
 	if err != nil {
 		// Nack and requeue I guess? It will end up getting an extra retry,
 		//   but better than DLQing it right away?
-		log.Warn("Failed message failed to decrement retries")
+		failSpan(span, err)
+		logger.WithError(err).Warn("Failed message failed to decrement retries")
 		delivery.Nack(false, true)
 	} else {
+		retriesTotal.WithLabelValues(queue.Name).Inc()
+		logger.WithField("delay_seconds", delay).Debug("Scheduled retry")
+		delivery.Ack(false)
+	}
+}
+
+// Starts the span that schedules the delivery's next attempt, and replaces
+// the trace context in its headers with it, so that the next attempt is
+// traced under the retry rather than the original enqueue.
+func startRetrySpan(queue *amqp.Queue, delivery *amqp.Delivery, attempt int, delay int64) trace.Span {
+	ctx, span := tracer.Start(traceContextFromDelivery(context.Background(), delivery), "rmqhttp.retry",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			queueTraceAttribute.String(queue.Name),
+			taskIdTraceAttribute.String(delivery.MessageId),
+			attemptTraceAttribute.Int(attempt),
+			delayTraceAttribute.Int64(delay),
+		),
+	)
+
+	injectTraceContext(ctx, delivery.Headers)
+	return span
+}
+
+// Sends the delivery to the queue's DLX with the reason, and the failure of
+// the last attempt, if there was one, recorded in its headers.
+// A nack can't change a message's headers, so the message is published to the
+// DLX directly, and then acked.
+// If that publish fails, the delivery is nacked instead, which still gets it
+// to the DLQ, just without the reason.
+func (rmq *RMQ) DeadLetter(queue *amqp.Queue, delivery *amqp.Delivery, reason string, failure *DeliveryFailure) {
+	headers := amqp.Table{}
+	for key, value := range delivery.Headers {
+		headers[key] = value
+	}
+
+	attempts, err := ToInt(headers[attemptsHeaderName])
+	if err != nil {
+		attempts = 0
+	}
+
+	deadLettersTotal.WithLabelValues(queue.Name, reason).Inc()
+	logger := deliveryLogger(queue, delivery).WithField(reasonLogField, reason)
+
+	now := time.Now()
+	recordFailure(headers, attempts, failure, now)
+	headers[deadLetterReasonHeaderName] = reason
+	headers[deadLetteredAtHeaderName] = now
+
+	err = rmq.Publish(
+		DeadLetterExchangeName(queue.Name),
+		"",
+		amqp.Publishing{
+			MessageId:    delivery.MessageId,
+			ContentType:  delivery.ContentType,
+			DeliveryMode: delivery.DeliveryMode,
+			Body:         delivery.Body,
+			Headers:      headers,
+		},
+	)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to record dead letter reason")
+		delivery.Nack(false, false)
+	} else {
+		logger.Info("Dead-lettered task")
 		delivery.Ack(false)
 	}
 }
@@ -1,6 +1,7 @@
 package rmqhttp
 
 import (
+	"crypto/tls"
 	"fmt"
 	"math"
 	"strconv"
@@ -16,6 +17,9 @@ import (
 const DelayInfrastructureBitCount = 28
 const DelayInfrastructureDeliveryExchange = "delay-infra-deliver"
 
+// Longest delay, in seconds, that the layers can represent.
+const DelayInfrastructureMaxDelay = int64(1)<<DelayInfrastructureBitCount - 1
+
 type DelayInfrastructureRoutingLayer struct {
 	ExchangeName            string
 	ActiveRoutingKey        string
@@ -64,7 +68,13 @@ func MissRoutingKey(index, bitCount int) string {
 }
 
 func DestroyInfrastructure(connectionString string) error {
+	return DestroyInfrastructureWithTLS(connectionString, nil)
+}
+
+// Same as DestroyInfrastructure, but connects over TLS when tlsConfig is set.
+func DestroyInfrastructureWithTLS(connectionString string, tlsConfig *tls.Config) error {
 	rmq := NewRMQ()
+	rmq.TLSConfig = tlsConfig
 	if err := rmq.ConnectRMQ(connectionString); err != nil {
 		return err
 	}
@@ -89,7 +99,13 @@ func DestroyInfrastructure(connectionString string) error {
 }
 
 func DelayInfrastructure(connectionString string) error {
+	return DelayInfrastructureWithTLS(connectionString, nil)
+}
+
+// Same as DelayInfrastructure, but connects over TLS when tlsConfig is set.
+func DelayInfrastructureWithTLS(connectionString string, tlsConfig *tls.Config) error {
 	rmq := NewRMQ()
+	rmq.TLSConfig = tlsConfig
 	if err := rmq.ConnectRMQ(connectionString); err != nil {
 		return err
 	}
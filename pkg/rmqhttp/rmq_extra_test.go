@@ -3,9 +3,11 @@ package rmqhttp
 import (
 	"math"
 	"testing"
+	"time"
 )
 
 import (
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,3 +31,88 @@ func TestDelayRoutingKey(t *testing.T) {
 		})
 	}
 }
+
+func TestReconnectDelay(t *testing.T) {
+	var tests = []struct {
+		name    string
+		attempt int
+		delay   time.Duration
+	}{
+		{"First Attempt", 0, time.Second},
+		{"Second Attempt", 1, 2 * time.Second},
+		{"Fifth Attempt", 4, 16 * time.Second},
+		{"Capped", 5, 30 * time.Second},
+		{"Overflow", 100, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.delay, ReconnectDelay(tt.attempt))
+		})
+	}
+}
+
+func TestRMQClose(t *testing.T) {
+	rmq := NewRMQ()
+	assert.False(t, rmq.IsConnected())
+	assert.False(t, rmq.IsClosed())
+
+	_, err := rmq.LockChannel()
+	assert.Equal(t, ErrNotConnected, err)
+
+	assert.NoError(t, rmq.Close())
+	assert.True(t, rmq.IsClosed())
+}
+
+func TestPublishNotConnected(t *testing.T) {
+	rmq := NewRMQ()
+	assert.Equal(t, defaultPublishTimeout, rmq.PublishTimeout)
+
+	err := rmq.Publish("", "q", amqp.Publishing{Body: []byte("{}")})
+	assert.Equal(t, ErrNotConnected, err)
+}
+
+func TestUnpreparedQueues(t *testing.T) {
+	rmq := NewRMQ()
+	rmq.preparedQueues = map[string]bool{"a": true, "b": true, "c": true}
+	rmq.QueueCache["b"] = &amqp.Queue{Name: "b"}
+
+	// Queues that failed to prepare on the new connection stay listed, so
+	//   they're retried.
+	assert.Equal(t, []string{"a", "c"}, rmq.unpreparedQueues(nil))
+
+	assert.NoError(t, rmq.Close())
+	assert.Empty(t, rmq.unpreparedQueues(nil))
+}
+
+func TestWaitForConfirm(t *testing.T) {
+	var tests = []struct {
+		name         string
+		confirmation *amqp.Confirmation
+		closed       bool
+		reusable     bool
+		err          error
+	}{
+		{"Acked", &amqp.Confirmation{DeliveryTag: 1, Ack: true}, false, true, nil},
+		{"Nacked", &amqp.Confirmation{DeliveryTag: 1, Ack: false}, false, true, ErrPublishNacked},
+		{"Timed Out", nil, false, false, ErrPublishTimeout},
+		{"Channel Closed", nil, true, false, errChannelClosed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confirms := make(chan amqp.Confirmation, 1)
+			if tt.confirmation != nil {
+				confirms <- *tt.confirmation
+			}
+
+			if tt.closed {
+				close(confirms)
+			}
+
+			reusable, err := waitForConfirm(confirms, 10*time.Millisecond)
+			assert.Equal(t, tt.reusable, reusable)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
@@ -10,7 +10,14 @@ type messageStats struct {
 	PublishDetails rate `json:"publish_details"`
 }
 
+type consumerDetails struct {
+	PrefetchCount int `json:"prefetch_count"`
+}
+
 type rmqStats struct {
-	Messages     int
-	MessageStats messageStats `json:"message_stats"`
+	Messages               int
+	MessagesUnacknowledged int               `json:"messages_unacknowledged"`
+	Consumers              int               `json:"consumers"`
+	ConsumerDetails        []consumerDetails `json:"consumer_details"`
+	MessageStats           messageStats      `json:"message_stats"`
 }
@@ -0,0 +1,238 @@
+package rmqhttp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Header the worker signs outbound requests with, as t=<unix time>,v1=<hex>.
+const SignatureHeaderName = "X-Rmqhttp-Signature"
+
+// Environment variable holding the secret used for queues and hosts that
+// aren't given their own.
+const SigningSecretEnvName = "RMQHTTP_SIGNING_SECRET"
+
+// How far a signature's timestamp may be from the receiver's clock, by
+// default.
+const DefaultSignatureTolerance = 5 * time.Minute
+
+var ErrInvalidSignature = errors.New("invalid signature")
+var ErrSignatureExpired = errors.New("signature timestamp outside of tolerance")
+
+// Signs requests to an endpoint host, or to every endpoint of a queue.
+// Exactly one of Queue and Host, and one of Secret and SecretEnv, the name of
+// an environment variable holding the secret, must be given.
+type SigningSecretConfig struct {
+	Queue     string
+	Host      string
+	Secret    string
+	SecretEnv string
+}
+
+// Picks the secret for a delivery.
+// Secrets for an endpoint's host take precedence over those for its queue,
+// which take precedence over the default.
+type SigningSecrets struct {
+	byQueue  map[string][]byte
+	byHost   map[string][]byte
+	fallback []byte
+}
+
+func NewSigningSecrets(configs []SigningSecretConfig, fallback string) (*SigningSecrets, error) {
+	s := SigningSecrets{
+		byQueue: map[string][]byte{},
+		byHost:  map[string][]byte{},
+	}
+
+	if fallback != "" {
+		s.fallback = []byte(fallback)
+	}
+
+	for _, config := range configs {
+		secret, err := config.resolve()
+		if err != nil {
+			return nil, err
+		}
+
+		if config.Queue != "" {
+			s.byQueue[config.Queue] = secret
+		} else {
+			s.byHost[strings.ToLower(config.Host)] = secret
+		}
+	}
+
+	return &s, nil
+}
+
+func (c *SigningSecretConfig) resolve() ([]byte, error) {
+	if (c.Queue == "") == (c.Host == "") {
+		return nil, fmt.Errorf("signing secret must be for exactly one of a queue or a host")
+	}
+
+	if (c.Secret == "") == (c.SecretEnv == "") {
+		return nil, fmt.Errorf("signing secret for %s%s must give exactly one of a secret or an environment variable", c.Queue, c.Host)
+	}
+
+	if c.Secret != "" {
+		return []byte(c.Secret), nil
+	}
+
+	secret := os.Getenv(c.SecretEnv)
+	if secret == "" {
+		return nil, fmt.Errorf("environment variable %s for signing secret is empty", c.SecretEnv)
+	}
+
+	return []byte(secret), nil
+}
+
+// Returns nil if requests to the endpoint shouldn't be signed.
+func (s *SigningSecrets) SecretFor(queue, endpoint string) []byte {
+	if s == nil {
+		return nil
+	}
+
+	if u, err := url.Parse(endpoint); err == nil {
+		if secret, ok := s.byHost[strings.ToLower(u.Hostname())]; ok {
+			return secret
+		}
+	}
+
+	if secret, ok := s.byQueue[queue]; ok {
+		return secret
+	}
+
+	return s.fallback
+}
+
+// Computes the hex HMAC-SHA256 of the method, URL, unix timestamp, and body,
+// each separated by a newline.
+// The URL is canonicalized first; see CanonicalSignatureUrl.
+func ComputeSignature(secret []byte, method, requestUrl string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, strings.ToUpper(method), CanonicalSignatureUrl(requestUrl))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reduces a URL to the lowercased scheme and host, and the request URI, as
+// it's sent on the request line, so http://Host and http://host/ sign the
+// same way.
+// URLs that can't be parsed are used as they are.
+func CanonicalSignatureUrl(requestUrl string) string {
+	u, err := url.Parse(requestUrl)
+	if err != nil || u.Host == "" {
+		return requestUrl
+	}
+
+	return fmt.Sprintf("%s://%s%s", strings.ToLower(u.Scheme), strings.ToLower(u.Host), u.RequestURI())
+}
+
+// Signs the request as it's about to be sent, leaving its body to be read
+// again.
+func signRequest(req *http.Request, secret []byte, now time.Time) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	req.Header.Set(SignatureHeaderName, SignatureHeader(secret, req.Method, req.URL.String(), now, body))
+	return nil
+}
+
+// Builds the value of the signature header for a request sent at the time.
+func SignatureHeader(secret []byte, method, requestUrl string, timestamp time.Time, body []byte) string {
+	t := timestamp.Unix()
+	return fmt.Sprintf("t=%d,v1=%s", t, ComputeSignature(secret, method, requestUrl, t, body))
+}
+
+// Checks a signature header against the request it came with.
+// Any of several v1 signatures may match, so secrets can be rotated.
+func VerifySignature(secret []byte, header, method, requestUrl string, body []byte, tolerance time.Duration, now time.Time) error {
+	_, err := verifySignature(secret, header, method, requestUrl, body, tolerance, now)
+	return err
+}
+
+// Same as VerifySignature, but also returns the signature that matched.
+func verifySignature(secret []byte, header, method, requestUrl string, body []byte, tolerance time.Duration, now time.Time) (string, error) {
+	var timestamp int64
+	signatures := []string{}
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			return "", ErrInvalidSignature
+		}
+
+		switch key {
+		case "t":
+			t, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return "", ErrInvalidSignature
+			}
+			timestamp = t
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+
+	if timestamp == 0 || len(signatures) == 0 {
+		return "", ErrInvalidSignature
+	}
+
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > tolerance || age < -tolerance {
+		return "", ErrSignatureExpired
+	}
+
+	expected := []byte(ComputeSignature(secret, method, requestUrl, timestamp, body))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return signature, nil
+		}
+	}
+
+	return "", ErrInvalidSignature
+}
+
+// Verifies a request received from a worker, leaving its body to be read
+// again.
+// The URL is rebuilt from the request's Host, so receivers behind proxies
+// that rewrite it should call VerifySignature with the URL the task was
+// sent to instead.
+func VerifyRequest(r *http.Request, secret []byte, tolerance time.Duration) error {
+	_, err := verifyRequest(r, secret, tolerance)
+	return err
+}
+
+// Same as VerifyRequest, but also returns the signature that matched.
+func verifyRequest(r *http.Request, secret []byte, tolerance time.Duration) (string, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return "", err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	requestUrl := fmt.Sprintf("%s://%s%s", scheme, r.Host, r.URL.RequestURI())
+
+	return verifySignature(secret, r.Header.Get(SignatureHeaderName), r.Method, requestUrl, body, tolerance, time.Now())
+}
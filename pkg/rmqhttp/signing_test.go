@@ -0,0 +1,168 @@
+package rmqhttp
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+	header := SignatureHeader(secret, "POST", "http://example.com/hook", now, []byte("body"))
+
+	var tests = []struct {
+		name   string
+		secret []byte
+		header string
+		method string
+		url    string
+		body   string
+		now    time.Time
+		err    error
+	}{
+		{"Valid", secret, header, "POST", "http://example.com/hook", "body", now, nil},
+		{"Lowercase Method", secret, header, "post", "http://example.com/hook", "body", now, nil},
+		{"Rotated", secret, header + ",v1=abcd", "POST", "http://example.com/hook", "body", now, nil},
+		{"Wrong Secret", []byte("other"), header, "POST", "http://example.com/hook", "body", now, ErrInvalidSignature},
+		{"Wrong Method", secret, header, "PUT", "http://example.com/hook", "body", now, ErrInvalidSignature},
+		{"Wrong Url", secret, header, "POST", "http://example.com/other", "body", now, ErrInvalidSignature},
+		{"Wrong Body", secret, header, "POST", "http://example.com/hook", "other", now, ErrInvalidSignature},
+		{"Expired", secret, header, "POST", "http://example.com/hook", "body", now.Add(time.Hour), ErrSignatureExpired},
+		{"Future", secret, header, "POST", "http://example.com/hook", "body", now.Add(-time.Hour), ErrSignatureExpired},
+		{"Missing", secret, "", "POST", "http://example.com/hook", "body", now, ErrInvalidSignature},
+		{"No Signature", secret, "t=1685620800", "POST", "http://example.com/hook", "body", now, ErrInvalidSignature},
+		{"Bad Timestamp", secret, "t=soon,v1=abcd", "POST", "http://example.com/hook", "body", now, ErrInvalidSignature},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifySignature(tt.secret, tt.header, tt.method, tt.url, []byte(tt.body), DefaultSignatureTolerance, tt.now)
+			assert.Equal(t, tt.err, err)
+		})
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	secret := []byte("secret")
+	r := httptest.NewRequest("POST", "http://example.com/hook?a=b", strings.NewReader("body"))
+	r.Header.Set(SignatureHeaderName, SignatureHeader(secret, "POST", "http://example.com/hook?a=b", time.Now(), []byte("body")))
+
+	assert.NoError(t, VerifyRequest(r, secret, DefaultSignatureTolerance))
+
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "body", string(body))
+}
+
+func TestSignRequestVerifies(t *testing.T) {
+	secret := []byte("secret")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := VerifyRequest(r, secret, DefaultSignatureTolerance); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	var tests = []struct {
+		name     string
+		endpoint string
+	}{
+		{"No Path", server.URL},
+		{"Root", server.URL + "/"},
+		{"Path", server.URL + "/hook"},
+		{"Query", server.URL + "/hook?a=b&c=d"},
+		{"Upper Case Host", strings.Replace(server.URL, "http://", "HTTP://", 1)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("POST", tt.endpoint, strings.NewReader("body"))
+			assert.NoError(t, err)
+			assert.NoError(t, signRequest(req, secret, time.Now()))
+
+			resp, err := http.DefaultClient.Do(req)
+			assert.NoError(t, err)
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		})
+	}
+}
+
+func TestCanonicalSignatureUrl(t *testing.T) {
+	var tests = []struct {
+		name   string
+		input  string
+		output string
+	}{
+		{"No Path", "http://example.com", "http://example.com/"},
+		{"Case", "HTTPS://Example.com:8443/Hook", "https://example.com:8443/Hook"},
+		{"Query", "http://example.com/hook?a=b", "http://example.com/hook?a=b"},
+		{"Fragment", "http://example.com/hook#frag", "http://example.com/hook"},
+		{"Not A Url", "::", "::"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.output, CanonicalSignatureUrl(tt.input))
+		})
+	}
+}
+
+func TestSigningSecretsSecretFor(t *testing.T) {
+	t.Setenv("TEST_SIGNING_SECRET", "from-env")
+
+	secrets, err := NewSigningSecrets([]SigningSecretConfig{
+		{Queue: "q", Secret: "queue"},
+		{Host: "Example.com", SecretEnv: "TEST_SIGNING_SECRET"},
+	}, "default")
+	assert.NoError(t, err)
+
+	var tests = []struct {
+		name     string
+		queue    string
+		endpoint string
+		secret   string
+	}{
+		{"Host", "q", "http://example.com:8080/hook", "from-env"},
+		{"Queue", "q", "http://example.org/hook", "queue"},
+		{"Default", "other", "http://example.org/hook", "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.secret, string(secrets.SecretFor(tt.queue, tt.endpoint)))
+		})
+	}
+
+	unsigned, err := NewSigningSecrets(nil, "")
+	assert.NoError(t, err)
+	assert.Nil(t, unsigned.SecretFor("q", "http://example.com/hook"))
+}
+
+func TestNewSigningSecretsInvalid(t *testing.T) {
+	var tests = []struct {
+		name   string
+		config SigningSecretConfig
+	}{
+		{"Neither Queue Nor Host", SigningSecretConfig{Secret: "s"}},
+		{"Queue And Host", SigningSecretConfig{Queue: "q", Host: "h", Secret: "s"}},
+		{"No Secret", SigningSecretConfig{Queue: "q"}},
+		{"Secret And Env", SigningSecretConfig{Queue: "q", Secret: "s", SecretEnv: "E"}},
+		{"Empty Env", SigningSecretConfig{Queue: "q", SecretEnv: "TEST_SIGNING_SECRET_UNSET"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewSigningSecrets([]SigningSecretConfig{tt.config}, "")
+			assert.Error(t, err)
+		})
+	}
+}
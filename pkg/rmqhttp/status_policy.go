@@ -0,0 +1,187 @@
+package rmqhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type StatusOutcome int
+
+const (
+	StatusSuccess StatusOutcome = iota
+	StatusRetry
+	StatusDeadLetter
+)
+
+func (so StatusOutcome) String() string {
+	switch so {
+	case StatusSuccess:
+		return "success"
+	case StatusRetry:
+		return "retry"
+	case StatusDeadLetter:
+		return "dead-letter"
+	}
+
+	return "unknown"
+}
+
+type statusCodeRange struct {
+	Min int
+	Max int
+}
+
+// A set of HTTP status codes.
+// Each member is written as an exact code (404), a class of codes ("4xx"), or
+// an inclusive range ("500-503").
+// In JSON, exact codes may be given as numbers or strings.
+type StatusCodeSet []statusCodeRange
+
+func ParseStatusCodeSet(specs []string) (StatusCodeSet, error) {
+	set := StatusCodeSet{}
+	for _, spec := range specs {
+		r, err := parseStatusCodeRange(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		set = append(set, r)
+	}
+
+	return set, nil
+}
+
+func MustParseStatusCodeSet(specs ...string) StatusCodeSet {
+	set, err := ParseStatusCodeSet(specs)
+	if err != nil {
+		panic(err)
+	}
+
+	return set
+}
+
+func parseStatusCodeRange(spec string) (statusCodeRange, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+
+	if len(spec) == 3 && strings.HasSuffix(spec, "xx") {
+		class, err := strconv.Atoi(spec[:1])
+		if err != nil || class < 1 || class > 5 {
+			return statusCodeRange{}, fmt.Errorf("invalid status code class %q", spec)
+		}
+
+		return statusCodeRange{class * 100, class*100 + 99}, nil
+	}
+
+	bounds := strings.SplitN(spec, "-", 2)
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return statusCodeRange{}, fmt.Errorf("invalid status code %q", spec)
+	}
+
+	max := min
+	if len(bounds) == 2 {
+		max, err = strconv.Atoi(bounds[1])
+		if err != nil {
+			return statusCodeRange{}, fmt.Errorf("invalid status code %q", spec)
+		}
+	}
+
+	if min < 100 || max > 599 || min > max {
+		return statusCodeRange{}, fmt.Errorf("invalid status code range %q", spec)
+	}
+
+	return statusCodeRange{min, max}, nil
+}
+
+func (scs *StatusCodeSet) UnmarshalJSON(bytes []byte) error {
+	raw := []interface{}{}
+	if err := json.Unmarshal(bytes, &raw); err != nil {
+		return err
+	}
+
+	specs := []string{}
+	for _, member := range raw {
+		switch t := member.(type) {
+		case string:
+			specs = append(specs, t)
+		case float64:
+			specs = append(specs, strconv.Itoa(int(t)))
+		default:
+			return fmt.Errorf("invalid status code %v", member)
+		}
+	}
+
+	set, err := ParseStatusCodeSet(specs)
+	if err != nil {
+		return err
+	}
+
+	*scs = set
+	return nil
+}
+
+func (scs StatusCodeSet) Contains(code int) bool {
+	for _, r := range scs {
+		if code >= r.Min && code <= r.Max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Decides what happens to a task once its endpoint responds.
+// Codes are checked against Success, then Retry, then DeadLetter; any code in
+// none of them is retried.
+type StatusPolicy struct {
+	Success    StatusCodeSet
+	Retry      StatusCodeSet
+	DeadLetter StatusCodeSet
+}
+
+// Succeeds on 2xx, and dead-letters 4xx other than 408 and 429, since
+// repeating a request the endpoint rejected won't change its answer.
+func DefaultStatusPolicy() StatusPolicy {
+	return StatusPolicy{
+		Success:    MustParseStatusCodeSet("2xx"),
+		Retry:      MustParseStatusCodeSet("408", "429"),
+		DeadLetter: MustParseStatusCodeSet("4xx"),
+	}
+}
+
+// Returns a copy of the policy, with each set the payload gives replacing the
+// policy's own.
+// Empty sets are ignored, rather than leaving nothing that counts as success.
+func (sp StatusPolicy) ForPayload(payload *rmqPayload) StatusPolicy {
+	if len(payload.SuccessCodes) != 0 {
+		sp.Success = payload.SuccessCodes
+	}
+
+	if len(payload.RetryCodes) != 0 {
+		sp.Retry = payload.RetryCodes
+	}
+
+	if len(payload.DeadLetterCodes) != 0 {
+		sp.DeadLetter = payload.DeadLetterCodes
+	}
+
+	return sp
+}
+
+func (sp StatusPolicy) Outcome(code int) StatusOutcome {
+	if sp.Success.Contains(code) {
+		return StatusSuccess
+	}
+
+	if sp.Retry.Contains(code) {
+		return StatusRetry
+	}
+
+	if sp.DeadLetter.Contains(code) {
+		return StatusDeadLetter
+	}
+
+	return StatusRetry
+}
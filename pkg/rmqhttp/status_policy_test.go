@@ -0,0 +1,83 @@
+package rmqhttp
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultStatusPolicyOutcome(t *testing.T) {
+	var tests = []struct {
+		name    string
+		code    int
+		outcome StatusOutcome
+	}{
+		{"OK", 200, StatusSuccess},
+		{"No Content", 204, StatusSuccess},
+		{"Redirect", 302, StatusRetry},
+		{"Bad Request", 400, StatusDeadLetter},
+		{"Unprocessable", 422, StatusDeadLetter},
+		{"Request Timeout", 408, StatusRetry},
+		{"Too Many Requests", 429, StatusRetry},
+		{"Internal Server Error", 500, StatusRetry},
+		{"Service Unavailable", 503, StatusRetry},
+	}
+
+	sp := DefaultStatusPolicy()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.outcome, sp.Outcome(tt.code))
+		})
+	}
+}
+
+func TestStatusPolicyForPayload(t *testing.T) {
+	payload, err := NewRMQPayload([]byte(`{
+		"Endpoint": "http://example.com",
+		"SuccessCodes": ["2xx", 302],
+		"DeadLetterCodes": ["500-503"]
+	}`))
+	assert.NoError(t, err)
+
+	sp := DefaultStatusPolicy().ForPayload(payload)
+	assert.Equal(t, StatusSuccess, sp.Outcome(302))
+	assert.Equal(t, StatusDeadLetter, sp.Outcome(502))
+	assert.Equal(t, StatusRetry, sp.Outcome(504))
+	assert.Equal(t, StatusRetry, sp.Outcome(429))
+}
+
+func TestStatusPolicyForPayloadEmpty(t *testing.T) {
+	payload, err := NewRMQPayload([]byte(`{
+		"Endpoint": "http://example.com",
+		"SuccessCodes": [],
+		"RetryCodes": [],
+		"DeadLetterCodes": []
+	}`))
+	assert.NoError(t, err)
+
+	sp := DefaultStatusPolicy().ForPayload(payload)
+	assert.Equal(t, StatusSuccess, sp.Outcome(200))
+	assert.Equal(t, StatusRetry, sp.Outcome(429))
+	assert.Equal(t, StatusDeadLetter, sp.Outcome(400))
+}
+
+func TestParseStatusCodeSetInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		spec string
+	}{
+		{"Not A Number", "abc"},
+		{"Bad Class", "9xx"},
+		{"Out Of Range", "600"},
+		{"Backwards Range", "503-500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseStatusCodeSet([]string{tt.spec})
+			assert.Error(t, err)
+		})
+	}
+}
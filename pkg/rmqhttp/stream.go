@@ -0,0 +1,104 @@
+package rmqhttp
+
+import (
+	"fmt"
+	"time"
+)
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Streams are used to share small amounts of state between replicas.
+// Unlike queues, they keep their messages after they've been read, so a
+// process that starts late can still replay everything.
+// Requires RabbitMQ 3.9 or newer.
+func (rmq *RMQ) DeclareStream(name string, maxAge time.Duration) error {
+	channel, err := rmq.LockChannel()
+	if err != nil {
+		return err
+	}
+
+	args := amqp.Table{
+		"x-queue-type": "stream",
+		"x-max-age":    fmt.Sprintf("%ds", int64(maxAge.Seconds())),
+	}
+
+	// A failed declare closes the channel, as happens on brokers that don't
+	//   support streams, so it can't go back to the pool.
+	if _, err := channel.QueueDeclare(name, true, false, false, false, args); err != nil {
+		rmq.DiscardChannel(channel)
+		return err
+	}
+
+	rmq.UnlockChannel(channel)
+	return nil
+}
+
+// Reads the stream from the beginning, and keeps following it until the RMQ
+// is closed.
+// If the channel is lost, the stream is read again from the start, so handle
+// must be fine with seeing the same message more than once.
+func (rmq *RMQ) FollowStream(name string, handle func(amqp.Delivery)) {
+	attempt := 0
+	for !rmq.IsClosed() {
+		channel, msgs, err := rmq.startFollowingStream(name)
+		if err != nil {
+			if rmq.IsClosed() {
+				break
+			}
+
+			log.Warnf("Failed to follow stream %s: %s", name, err)
+			time.Sleep(ReconnectDelay(attempt))
+			attempt++
+			continue
+		}
+
+		attempt = 0
+		for delivery := range msgs {
+			handle(delivery)
+			delivery.Ack(false)
+		}
+
+		rmq.DiscardChannel(channel)
+	}
+}
+
+func (rmq *RMQ) startFollowingStream(name string) (*amqp.Channel, <-chan amqp.Delivery, error) {
+	channel, err := rmq.LockChannel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Streams can only be consumed with a prefetch set.
+	if err := channel.Qos(100, 0, false); err != nil {
+		rmq.DiscardChannel(channel)
+		return nil, nil, err
+	}
+
+	msgs, err := channel.Consume(
+		name,
+		"",
+		false,
+		false,
+		false,
+		false,
+		amqp.Table{"x-stream-offset": "first"},
+	)
+	if err != nil {
+		rmq.DiscardChannel(channel)
+		return nil, nil, err
+	}
+
+	return channel, msgs, nil
+}
+
+// Messages without a timestamp are treated as having just been published.
+func deliveryTimestamp(delivery amqp.Delivery) time.Time {
+	if delivery.Timestamp.IsZero() {
+		return time.Now()
+	}
+
+	return delivery.Timestamp
+}
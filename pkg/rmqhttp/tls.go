@@ -0,0 +1,160 @@
+package rmqhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// How often a CertificateReloader looks for changes to its files.
+const CertificateReloadInterval = 10 * time.Second
+
+// Describes how to connect to RMQ over TLS.
+//
+// CaFile:     PEM bundle of CAs to verify the broker against; the system's
+// CAs are used if not given.
+// CertFile:   PEM client certificate to present to the broker.
+// KeyFile:    Private key of CertFile.
+// ServerName: Name to verify the broker's certificate against, when it
+// differs from the host in the connection string.
+type AmqpTLSOptions struct {
+	CaFile     string
+	CertFile   string
+	KeyFile    string
+	ServerName string
+}
+
+func (o AmqpTLSOptions) IsEmpty() bool {
+	return o == AmqpTLSOptions{}
+}
+
+func NewAmqpTLSConfig(options AmqpTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: options.ServerName,
+	}
+
+	if options.CaFile != "" {
+		pem, err := os.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", options.CaFile)
+		}
+
+		config.RootCAs = pool
+	}
+
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, fmt.Errorf("a client certificate and key must be given together")
+	}
+
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// Serves a certificate and key from files, picking up changes to them
+// without a restart, as happens when they're renewed.
+// If the new files can't be loaded, the previous certificate keeps being
+// served.
+type CertificateReloader struct {
+	certPath string
+	keyPath  string
+
+	lock        sync.Mutex
+	certificate *tls.Certificate
+	modTimes    [2]time.Time
+	lastChecked time.Time
+}
+
+func NewCertificateReloader(certPath, keyPath string) (*CertificateReloader, error) {
+	r := CertificateReloader{certPath: certPath, keyPath: keyPath}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+// Must be called with the lock held, or before the reloader is shared.
+func (r *CertificateReloader) reload() error {
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return err
+	}
+
+	r.certificate = &cert
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *CertificateReloader) currentModTimes() ([2]time.Time, error) {
+	modTimes := [2]time.Time{}
+	for i, path := range []string{r.certPath, r.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return modTimes, err
+		}
+
+		modTimes[i] = info.ModTime()
+	}
+
+	return modTimes, nil
+}
+
+// Suitable for tls.Config.GetCertificate.
+func (r *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.lastChecked) >= CertificateReloadInterval {
+		r.lastChecked = now
+		r.reloadIfChanged()
+	}
+
+	return r.certificate, nil
+}
+
+// Must be called with the lock held.
+func (r *CertificateReloader) reloadIfChanged() {
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		log.Warnf("Failed to check certificate for changes: %s", err)
+		return
+	}
+
+	if modTimes == r.modTimes {
+		return
+	}
+
+	if err := r.reload(); err != nil {
+		log.Warnf("Failed to reload certificate; still serving the previous one: %s", err)
+		return
+	}
+
+	log.Infof("Reloaded certificate from %s", r.certPath)
+}
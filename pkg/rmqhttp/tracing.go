@@ -0,0 +1,75 @@
+package rmqhttp
+
+import (
+	"context"
+	"net/http"
+)
+
+import (
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans come from whichever tracer provider is registered globally; without
+// one, nothing is recorded, but trace context is still passed along.
+var tracer = otel.Tracer("github.com/Eagerod/rmqhttp")
+
+// W3C trace context is always used, so tasks carry a traceparent whether or
+// not this process exports spans.
+var tracePropagator = propagation.TraceContext{}
+
+const (
+	queueTraceAttribute    = attribute.Key("rmqhttp.queue")
+	taskIdTraceAttribute   = attribute.Key("rmqhttp.task_id")
+	attemptTraceAttribute  = attribute.Key("rmqhttp.attempt")
+	delayTraceAttribute    = attribute.Key("rmqhttp.delay_seconds")
+	endpointTraceAttribute = attribute.Key("http.url")
+	methodTraceAttribute   = attribute.Key("http.method")
+	statusTraceAttribute   = attribute.Key("http.status_code")
+)
+
+// Lets trace context be read from, and written to, a message's headers.
+type amqpHeaderCarrier amqp.Table
+
+func (c amqpHeaderCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c amqpHeaderCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c amqpHeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+func traceContextFromRequest(r *http.Request) context.Context {
+	return tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+}
+
+func traceContextFromDelivery(ctx context.Context, delivery *amqp.Delivery) context.Context {
+	return tracePropagator.Extract(ctx, amqpHeaderCarrier(delivery.Headers))
+}
+
+func injectTraceContext(ctx context.Context, headers amqp.Table) {
+	tracePropagator.Inject(ctx, amqpHeaderCarrier(headers))
+}
+
+func injectTraceContextIntoRequest(ctx context.Context, req *http.Request) {
+	tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+}
+
+func failSpan(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,54 @@
+package rmqhttp
+
+import (
+	"context"
+	"testing"
+)
+
+import (
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	delivery := amqp.Delivery{Headers: amqp.Table{"traceparent": traceparent}}
+	ctx := traceContextFromDelivery(context.Background(), &delivery)
+
+	spanContext := trace.SpanContextFromContext(ctx)
+	assert.True(t, spanContext.IsRemote())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spanContext.TraceID().String())
+
+	headers := amqp.Table{}
+	injectTraceContext(ctx, headers)
+	assert.Equal(t, traceparent, headers["traceparent"])
+}
+
+func TestTraceContextMissing(t *testing.T) {
+	headers := amqp.Table{}
+	injectTraceContext(context.Background(), headers)
+	assert.Empty(t, headers)
+
+	delivery := amqp.Delivery{Headers: amqp.Table{"traceparent": 12}}
+	assert.False(t, trace.SpanContextFromContext(traceContextFromDelivery(context.Background(), &delivery)).IsValid())
+}
+
+func TestStartRetrySpan(t *testing.T) {
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+
+	traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	delivery := amqp.Delivery{Headers: amqp.Table{"traceparent": traceparent}}
+
+	span := startRetrySpan(&amqp.Queue{Name: "q"}, &delivery, 2, 4)
+	span.End()
+
+	// The next attempt is parented to the retry, in the same trace.
+	spanContext := trace.SpanContextFromContext(traceContextFromDelivery(context.Background(), &delivery))
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spanContext.TraceID().String())
+	assert.Equal(t, span.SpanContext().SpanID(), spanContext.SpanID())
+	assert.NotEqual(t, "00f067aa0ba902b7", spanContext.SpanID().String())
+}
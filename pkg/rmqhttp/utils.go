@@ -2,6 +2,11 @@ package rmqhttp
 
 import (
 	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // https://stackoverflow.com/a/52826567
@@ -37,3 +42,33 @@ func ToInt(anint interface{}) (int, error) {
 
 	return i, nil
 }
+
+// Parses a Retry-After header, in either its delta-seconds or HTTP-date form,
+// into the number of seconds to wait from now.
+// Dates in the past mean retrying right away.
+func ParseRetryAfter(value string, now time.Time) (int64, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+
+		return seconds, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	delay := date.Sub(now)
+	if delay < 0 {
+		return 0, true
+	}
+
+	return int64(math.Ceil(delay.Seconds())), true
+}
@@ -0,0 +1,37 @@
+package rmqhttp
+
+import (
+	"testing"
+	"time"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, time.June, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name   string
+		value  string
+		delay  int64
+		parsed bool
+	}{
+		{"Empty", "", 0, false},
+		{"Seconds", "120", 120, true},
+		{"Zero Seconds", "0", 0, true},
+		{"Negative Seconds", "-5", 0, false},
+		{"Date", "Thu, 01 Jun 2023 12:05:00 GMT", 300, true},
+		{"Date In The Past", "Thu, 01 Jun 2023 11:00:00 GMT", 0, true},
+		{"Garbage", "soon", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, parsed := ParseRetryAfter(tt.value, now)
+			assert.Equal(t, tt.parsed, parsed)
+			assert.Equal(t, tt.delay, delay)
+		})
+	}
+}
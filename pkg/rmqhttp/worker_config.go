@@ -0,0 +1,108 @@
+package rmqhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Describes how a worker consumes a single queue.
+//
+// Name:      Queue to consume.
+// Consumers: Number of concurrent consumers to run against the queue.
+// Prefetch:  Number of unacknowledged deliveries the broker will push to each
+// consumer.
+// 0 leaves it up to the broker.
+type QueueConfig struct {
+	Name      string
+	Consumers int
+	Prefetch  int
+}
+
+// Contents of the file given to the worker's --config flag.
+type WorkerConfig struct {
+	Queues         []QueueConfig
+	SigningSecrets []SigningSecretConfig
+}
+
+// Parses a queue given as name[:consumers[:prefetch]].
+// Any part not given takes the value of the matching default.
+func ParseQueueConfig(spec string, defaultConsumers, defaultPrefetch int) (QueueConfig, error) {
+	qc := QueueConfig{Consumers: defaultConsumers, Prefetch: defaultPrefetch}
+
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return qc, fmt.Errorf("invalid queue %q; expected name[:consumers[:prefetch]]", spec)
+	}
+
+	qc.Name = parts[0]
+
+	if len(parts) > 1 {
+		consumers, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return qc, fmt.Errorf("invalid consumer count in queue %q", spec)
+		}
+
+		qc.Consumers = consumers
+	}
+
+	if len(parts) > 2 {
+		prefetch, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return qc, fmt.Errorf("invalid prefetch in queue %q", spec)
+		}
+
+		qc.Prefetch = prefetch
+	}
+
+	return qc, qc.Validate()
+}
+
+func (qc *QueueConfig) Validate() error {
+	if qc.Name == "" {
+		return fmt.Errorf("queue name must not be empty")
+	}
+
+	if qc.Consumers < 1 {
+		return fmt.Errorf("queue %s must have at least 1 consumer", qc.Name)
+	}
+
+	if qc.Prefetch < 0 {
+		return fmt.Errorf("queue %s must not have a negative prefetch", qc.Name)
+	}
+
+	return nil
+}
+
+// Reads a JSON worker config.
+// Queues that don't give a consumer count or prefetch take the given defaults.
+func LoadWorkerConfig(path string, defaultConsumers, defaultPrefetch int) (*WorkerConfig, error) {
+	bytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := WorkerConfig{}
+	if err := json.Unmarshal(bytes, &config); err != nil {
+		return nil, fmt.Errorf("invalid worker config %s: %w", path, err)
+	}
+
+	for i := range config.Queues {
+		qc := &config.Queues[i]
+		if qc.Consumers == 0 {
+			qc.Consumers = defaultConsumers
+		}
+
+		if qc.Prefetch == 0 {
+			qc.Prefetch = defaultPrefetch
+		}
+
+		if err := qc.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
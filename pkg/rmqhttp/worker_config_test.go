@@ -0,0 +1,51 @@
+package rmqhttp
+
+import (
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueueConfig(t *testing.T) {
+	var tests = []struct {
+		name   string
+		spec   string
+		output QueueConfig
+	}{
+		{"Name Only", "q", QueueConfig{"q", 4, 0}},
+		{"Consumers", "q:2", QueueConfig{"q", 2, 0}},
+		{"Consumers And Prefetch", "q:2:10", QueueConfig{"q", 2, 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			qc, err := ParseQueueConfig(tt.spec, 4, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.output, qc)
+		})
+	}
+}
+
+func TestParseQueueConfigInvalid(t *testing.T) {
+	var tests = []struct {
+		name string
+		spec string
+	}{
+		{"Empty", ""},
+		{"No Name", ":2"},
+		{"Bad Consumers", "q:two"},
+		{"Zero Consumers", "q:0"},
+		{"Bad Prefetch", "q:2:ten"},
+		{"Negative Prefetch", "q:2:-1"},
+		{"Too Many Parts", "q:2:10:1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseQueueConfig(tt.spec, 4, 0)
+			assert.Error(t, err)
+		})
+	}
+}
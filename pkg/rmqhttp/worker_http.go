@@ -0,0 +1,112 @@
+package rmqhttp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// Serves the worker's own endpoints on the address, while it's running.
+// An empty address, the default, doesn't listen at all.
+func (w *Worker) SetListenAddress(address string) {
+	w.listenAddress = address
+}
+
+func (w *Worker) Router() *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/metrics", promhttp.Handler()).Methods("GET")
+	r.HandleFunc("/healthz", w.LivenessHandler).Methods("GET")
+	r.HandleFunc("/readyz", w.ReadinessHandler).Methods("GET")
+	return r
+}
+
+type WorkerReadiness struct {
+	Connected         bool `json:"connected"`
+	Consumers         int  `json:"consumers"`
+	ExpectedConsumers int  `json:"expected_consumers"`
+}
+
+func (r WorkerReadiness) Ready() bool {
+	return r.Connected && r.Consumers >= r.ExpectedConsumers
+}
+
+// The worker is live until its connection has been closed for good; while
+// it is reconnecting, it is only unready.
+func (w *Worker) LivenessHandler(rw http.ResponseWriter, r *http.Request) {
+	if w.rmq.IsClosed() {
+		respondWorkerError(rw, http.StatusServiceUnavailable, "Connection closed")
+		return
+	}
+}
+
+// The worker is ready when it's connected, and every consumer it was
+// configured with is registered with the broker.
+func (w *Worker) ReadinessHandler(rw http.ResponseWriter, r *http.Request) {
+	readiness := w.Readiness()
+
+	statusCode := http.StatusOK
+	if !readiness.Ready() {
+		statusCode = http.StatusServiceUnavailable
+	}
+
+	aJson, err := json.Marshal(readiness)
+	if err != nil {
+		panic(err)
+	}
+
+	rw.Header()["Content-Type"] = []string{"application/json"}
+	rw.WriteHeader(statusCode)
+	rw.Write(aJson)
+}
+
+func (w *Worker) Readiness() WorkerReadiness {
+	expected := 0
+	for _, qc := range w.queues {
+		expected += qc.Consumers
+	}
+
+	w.consumerLock.Lock()
+	consumers := len(w.consumerChannels)
+	stopping := w.stopping
+	w.consumerLock.Unlock()
+
+	return WorkerReadiness{
+		Connected:         w.rmq.IsConnected() && !stopping,
+		Consumers:         consumers,
+		ExpectedConsumers: expected,
+	}
+}
+
+func respondWorkerError(rw http.ResponseWriter, statusCode int, message string) {
+	rw.Header()["Content-Type"] = []string{"application/json"}
+	rw.WriteHeader(statusCode)
+	rw.Write(NewJsonError(http.StatusText(statusCode), message).Json())
+}
+
+func (w *Worker) listen() {
+	if w.listenAddress == "" {
+		return
+	}
+
+	w.server = &http.Server{Addr: w.listenAddress, Handler: w.Router()}
+	go func() {
+		log.Infof("Worker listening on %s", w.listenAddress)
+		if err := w.server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Errorf("Worker listener stopped: %s", err)
+		}
+	}()
+}
+
+func (w *Worker) stopListening(ctx context.Context) error {
+	if w.server == nil {
+		return nil
+	}
+
+	return w.server.Shutdown(ctx)
+}
@@ -0,0 +1,51 @@
+package rmqhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+import (
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerReadiness(t *testing.T) {
+	var tests = []struct {
+		name      string
+		readiness WorkerReadiness
+		ready     bool
+	}{
+		{"All Consumers", WorkerReadiness{true, 4, 4}, true},
+		{"Missing Consumers", WorkerReadiness{true, 3, 4}, false},
+		{"Disconnected", WorkerReadiness{false, 4, 4}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.ready, tt.readiness.Ready())
+		})
+	}
+}
+
+func TestWorkerHealthEndpoints(t *testing.T) {
+	worker := NewWorker([]QueueConfig{{Name: "q", Consumers: 2}})
+	router := worker.Router()
+
+	var tests = []struct {
+		name       string
+		path       string
+		statusCode int
+	}{
+		{"Live Before Connecting", "/healthz", http.StatusOK},
+		{"Not Ready Before Connecting", "/readyz", http.StatusServiceUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := httptest.NewRecorder()
+			router.ServeHTTP(rw, httptest.NewRequest("GET", tt.path, nil))
+			assert.Equal(t, tt.statusCode, rw.Code)
+		})
+	}
+}